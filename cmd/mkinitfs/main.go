@@ -4,20 +4,24 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"time"
 
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/archive"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/bootdeploy"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist/exclude"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist/hookdirs"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist/hookfiles"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist/hookgen"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist/hookscripts"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist/initramfs"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist/modules"
@@ -46,7 +50,64 @@ func main() {
 
 	var disableBootDeploy bool
 	flag.BoolVar(&disableBootDeploy, "no-bootdeploy", false, "Disable running 'boot-deploy' after generating archives.")
-	flag.Parse()
+
+	var outputFormatStr string
+	flag.StringVar(&outputFormatStr, "format", string(archive.OutputCpio), "Output format for archives: cpio, tar or dir. Archives in formats other than cpio are written directly to the output directory, without running 'boot-deploy'.")
+
+	var verify bool
+	flag.BoolVar(&verify, "verify", false, "Read back and check each archive after writing it. Enabled by default when the output directory is /boot.")
+
+	var noStrictModules bool
+	flag.BoolVar(&noStrictModules, "no-strict-modules", false, "Only warn about entries in lists of modules that are neither a loadable module nor built into the kernel.")
+
+	var ignoreModuleChecks bool
+	flag.BoolVar(&ignoreModuleChecks, "ignore-module-checks", false, "Only warn about included kernel modules that were built for a different kernel version, or that aren't signed when the kernel requires it.")
+
+	var sizeReportLen int
+	flag.IntVar(&sizeReportLen, "n", 20, "Number of largest files to show with 'size'.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [size|bench]\n", filepath.Base(os.Args[0]))
+		fmt.Fprintln(flag.CommandLine.Output(), "\nCommands:")
+		fmt.Fprintln(flag.CommandLine.Output(), "  size\tShow what contributes to the size of the archives, without writing them")
+		fmt.Fprintln(flag.CommandLine.Output(), "  bench\tCompare compression formats and levels on the archives, without writing them")
+		fmt.Fprintln(flag.CommandLine.Output(), "\nOptions:")
+		flag.PrintDefaults()
+	}
+
+	// optional subcommand, followed by options
+	var command string
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		retCode = 2
+		return
+	}
+	verifySet := false
+	outDirSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "verify":
+			verifySet = true
+		case "d":
+			outDirSet = true
+		}
+	})
+	if !verifySet {
+		verify = filepath.Clean(*outDir) == "/boot"
+	}
+
+	switch command {
+	case "", "size", "bench":
+	default:
+		log.Printf("Unknown command: %q", command)
+		flag.Usage()
+		retCode = 2
+		return
+	}
 
 	var verbose bool
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose output.")
@@ -58,6 +119,27 @@ func main() {
 
 	log.Default().SetFlags(log.Lmicroseconds)
 
+	outputFormat, err := archive.ParseOutputFormat(outputFormatStr)
+	if err != nil {
+		log.Println(err)
+		retCode = 1
+		return
+	}
+	// archives in other formats are written directly to the output dir, where
+	// they would replace the bootable archives in /boot
+	if outputFormat != archive.OutputCpio && command == "" {
+		if !outDirSet {
+			log.Printf("-format %s requires an output directory, set with -d", outputFormat)
+			retCode = 2
+			return
+		}
+		if filepath.Clean(*outDir) == "/boot" {
+			log.Printf("refusing to write archives with format %s to /boot", outputFormat)
+			retCode = 2
+			return
+		}
+	}
+
 	var devinfo deviceinfo.DeviceInfo
 	deverr_usr := devinfo.ReadDeviceinfo("/usr/share/deviceinfo/deviceinfo")
 	deverr_etc := devinfo.ReadDeviceinfo("/etc/deviceinfo")
@@ -78,6 +160,17 @@ func main() {
 		return
 	}
 
+	// the kernel config is used to check that the kernel supports the
+	// configuration, if it can be found
+	kernelConfig, kernelConfigPath, kernelConfigErr := osutil.GetKernelConfig(kernVer)
+	if kernelConfigErr != nil {
+		log.Println(kernelConfigErr)
+		log.Println("Unable to check that the kernel supports the configuration")
+		kernelConfig = nil
+	} else {
+		log.Print("Using kernel config: ", kernelConfigPath)
+	}
+
 	// temporary working dir
 	workDir, err := os.MkdirTemp("", "mkinitfs")
 	if err != nil {
@@ -97,6 +190,65 @@ func main() {
 	log.Print("Generating for kernel version: ", kernVer)
 	log.Print("Output directory: ", *outDir)
 
+	// Only cpio archives are finalized by boot-deploy, anything else is
+	// written directly to the output directory
+	archiveDir := workDir
+	if command != "" {
+		// reports only, nothing is written
+		disableBootDeploy = true
+	} else if outputFormat != archive.OutputCpio {
+		log.Printf("Using output format %s, 'boot-deploy' will not be run", outputFormat)
+		archiveDir = *outDir
+		disableBootDeploy = true
+	}
+
+	modulesCompression := modules.ExtractCompression(devinfo.ModulesCompression)
+	if modulesCompression != modules.CompressionKeep {
+		log.Printf("Storing kernel modules with compression format %s", modulesCompression)
+	}
+
+	// one config for all modules, so that module indexes are only read once
+	modulesConfig := modules.DefaultConfig()
+
+	// Lists of modules are only filtered in host-only mode, everything else
+	// is always included. Firmware for the modules is included unless it's
+	// disabled in deviceinfo.
+	configureModules := func(m *modules.Modules) *modules.Modules {
+		if devinfo.ModulesSkipFirmware {
+			m.SkipFirmware()
+		}
+		if noStrictModules {
+			m.NonStrict()
+		}
+		if ignoreModuleChecks {
+			m.IgnoreModuleChecks()
+		}
+		return m
+	}
+	newModules := func(path string) filelist.FileLister {
+		if devinfo.InitfsHostonly {
+			return configureModules(modules.NewHostOnly(path, "/sys", "/proc/modules", devinfo, modulesConfig))
+		}
+		return configureModules(modules.New(path, devinfo, modulesConfig))
+	}
+	if devinfo.InitfsHostonly {
+		log.Println("Including only kernel modules needed by this system from module directories")
+	}
+
+	firmwareSupport, firmwareSupportFound := getFirmwareSupport(devinfo, kernelConfig)
+	if firmwareSupportFound {
+		log.Printf("Kernel can load firmware with compression formats: %q", firmwareSupport)
+	}
+
+	if kernelConfig != nil {
+		if err := checkKernelConfig(kernelConfig, devinfo, firmwareSupport); err != nil {
+			log.Println(err)
+			log.Println("The kernel doesn't support the configuration, see above")
+			retCode = 1
+			return
+		}
+	}
+
 	//
 	// initramfs
 	//
@@ -107,26 +259,59 @@ func main() {
 
 	start := time.Now()
 	initramfsAr := archive.New(compressionFormat, compressionLevel)
-	initfs := initramfs.New([]filelist.FileLister{
-		hookdirs.New("/usr/share/mkinitfs/dirs"),
-		hookdirs.New("/etc/mkinitfs/dirs"),
-		hookfiles.New("/usr/share/mkinitfs/files"),
-		hookfiles.New("/etc/mkinitfs/files"),
+	initramfsAr.SetOutputFormat(outputFormat)
+	if devinfo.InitfsStrip {
+		log.Println("- Stripping debug info from binaries and libraries")
+	}
+	initramfsAr.AddTransform(archive.NewStripDebug(devinfo.InitfsStrip))
+	initramfsAr.AddTransform(modules.NewCompressionTransform(modulesCompression))
+	if firmwareSupportFound {
+		initramfsAr.AddTransform(archive.NewDecompressFirmware(firmwareSupport))
+	}
+	initfsListers := []filelist.FileLister{
+		hookdirs.New("/usr/share/mkinitfs/dirs", devinfo),
+		hookdirs.New("/etc/mkinitfs/dirs", devinfo),
+		hookfiles.New("/usr/share/mkinitfs/files", devinfo),
+		hookfiles.New("/etc/mkinitfs/files", devinfo),
 		hookscripts.New("/usr/share/mkinitfs/hooks", "/hooks"),
 		hookscripts.New("/etc/mkinitfs/hooks", "/hooks"),
 		hookscripts.New("/usr/share/mkinitfs/hooks-cleanup", "/hooks-cleanup"),
 		hookscripts.New("/etc/mkinitfs/hooks-cleanup", "/hooks-cleanup"),
-		modules.New("/usr/share/mkinitfs/modules"),
-		modules.New("/etc/mkinitfs/modules"),
-	})
-	initfsExtra := initramfs.New([]filelist.FileLister{
-		hookfiles.New("/usr/share/mkinitfs/files-extra"),
-		hookfiles.New("/etc/mkinitfs/files-extra"),
+		newModules("/usr/share/mkinitfs/modules"),
+		newModules("/etc/mkinitfs/modules"),
+		hookgen.New("/usr/share/mkinitfs/gen", devinfo, kernVer, Version),
+		hookgen.New("/etc/mkinitfs/gen", devinfo, kernVer, Version),
+	}
+	// modules for the device tree are only added to the initramfs, since
+	// they may be needed to find the storage the initramfs-extra is on
+	if devinfo.ModulesFromDtb {
+		dtbs, err := getDtbs(devinfo)
+		if err != nil {
+			log.Println(err)
+			log.Println("failed to generate: ", "initramfs")
+			retCode = 1
+			return
+		}
+		initfsListers = append(initfsListers, configureModules(modules.NewDtb(dtbs, modulesConfig)))
+	}
+	excludeDirs := []string{"/usr/share/mkinitfs/exclude", "/etc/mkinitfs/exclude"}
+	extraExcludeDirs := []string{"/usr/share/mkinitfs/exclude-extra", "/etc/mkinitfs/exclude-extra"}
+	if !devinfo.CreateInitfsExtra {
+		// initramfs-extra files are added to the initramfs, so its exclude
+		// lists apply to them too
+		extraExcludeDirs = append(excludeDirs, extraExcludeDirs...)
+	}
+	initfs := exclude.New(initramfs.New(initfsListers), excludeDirs...)
+	initfsExtra := exclude.New(initramfs.New([]filelist.FileLister{
+		hookfiles.New("/usr/share/mkinitfs/files-extra", devinfo),
+		hookfiles.New("/etc/mkinitfs/files-extra", devinfo),
 		hookscripts.New("/usr/share/mkinitfs/hooks-extra", "/hooks-extra"),
 		hookscripts.New("/etc/mkinitfs/hooks-extra", "/hooks-extra"),
-		modules.New("/usr/share/mkinitfs/modules-extra"),
-		modules.New("/etc/mkinitfs/modules-extra"),
-	})
+		newModules("/usr/share/mkinitfs/modules-extra"),
+		newModules("/etc/mkinitfs/modules-extra"),
+		hookgen.New("/usr/share/mkinitfs/gen-extra", devinfo, kernVer, Version),
+		hookgen.New("/etc/mkinitfs/gen-extra", devinfo, kernVer, Version),
+	}), extraExcludeDirs...)
 
 	if err := initramfsAr.AddItems(initfs); err != nil {
 		log.Println(err)
@@ -146,7 +331,23 @@ func main() {
 		}
 	}
 
-	if err := initramfsAr.Write(filepath.Join(workDir, "initramfs"), os.FileMode(0644)); err != nil {
+	if kernelConfig != nil {
+		if err := modules.KernelSupport(kernelConfig, initramfsAr.Files(), modulesCompression); err != nil {
+			log.Println(err)
+			log.Println("failed to generate: ", "initramfs")
+			retCode = 1
+			return
+		}
+	}
+
+	if err := addModulesMetadata(modulesConfig, initramfsAr, nil, "initfs.order"); err != nil {
+		log.Println(err)
+		log.Println("failed to generate: ", "initramfs")
+		retCode = 1
+		return
+	}
+
+	if err := processArchive(command, initramfsAr, filepath.Join(archiveDir, "initramfs"), verify, sizeReportLen); err != nil {
 		log.Println(err)
 		log.Println("failed to generate: ", "initramfs")
 		retCode = 1
@@ -165,13 +366,38 @@ func main() {
 
 		start = time.Now()
 		initramfsExtraAr := archive.New(compressionFormat, compressionLevel)
+		initramfsExtraAr.SetOutputFormat(outputFormat)
+		if devinfo.InitfsExtraStrip {
+			log.Println("- Stripping debug info from binaries and libraries")
+		}
+		initramfsExtraAr.AddTransform(archive.NewStripDebug(devinfo.InitfsExtraStrip))
+		initramfsExtraAr.AddTransform(modules.NewCompressionTransform(modulesCompression))
+		if firmwareSupportFound {
+			initramfsExtraAr.AddTransform(archive.NewDecompressFirmware(firmwareSupport))
+		}
 		if err := initramfsExtraAr.AddItemsExclude(initfsExtra, initfs); err != nil {
 			log.Println(err)
 			log.Println("failed to generate: ", "initramfs-extra")
 			retCode = 1
 			return
 		}
-		if err := initramfsExtraAr.Write(filepath.Join(workDir, "initramfs-extra"), os.FileMode(0644)); err != nil {
+		if kernelConfig != nil {
+			if err := modules.KernelSupport(kernelConfig, initramfsExtraAr.Files(), modulesCompression); err != nil {
+				log.Println(err)
+				log.Println("failed to generate: ", "initramfs-extra")
+				retCode = 1
+				return
+			}
+		}
+		// initramfs-extra is extracted on top of the initramfs, so its
+		// module metadata has to cover the modules in both
+		if err := addModulesMetadata(modulesConfig, initramfsExtraAr, initramfsAr.Files(), "initfs-extra.order"); err != nil {
+			log.Println(err)
+			log.Println("failed to generate: ", "initramfs-extra")
+			retCode = 1
+			return
+		}
+		if err := processArchive(command, initramfsExtraAr, filepath.Join(archiveDir, "initramfs-extra"), verify, sizeReportLen); err != nil {
 			log.Println(err)
 			log.Println("failed to generate: ", "initramfs-extra")
 			retCode = 1
@@ -191,6 +417,173 @@ func main() {
 	}
 }
 
+// getFirmwareSupport returns the list of compression formats that the kernel
+// is able to load firmware in. This is read from deviceinfo if it's set there,
+// otherwise from the kernel config. If neither is available, found is false.
+func getFirmwareSupport(devinfo deviceinfo.DeviceInfo, config osutil.KernelConfig) (supported []string, found bool) {
+	if devinfo.FirmwareCompressionSupport != "" {
+		for _, format := range strings.Fields(devinfo.FirmwareCompressionSupport) {
+			switch format {
+			case "none":
+			case "xz":
+				supported = append(supported, misc.ExtXz)
+			case "zstd":
+				supported = append(supported, misc.ExtZstd)
+			default:
+				log.Printf("Unknown firmware compression format %q, ignoring", format)
+			}
+		}
+		return supported, true
+	}
+
+	if config == nil {
+		log.Println("Unable to detect kernel support for compressed firmware, firmware is included as-is")
+		return nil, false
+	}
+
+	return archive.FirmwareSupport(config), true
+}
+
+// getDtbs returns the paths of the device tree blobs to select modules with:
+// the ones named in deviceinfo_dtb, which are installed by the kernel package,
+// or if it's not set, the one that the running kernel was booted with.
+func getDtbs(devinfo deviceinfo.DeviceInfo) ([]string, error) {
+	names := strings.Fields(devinfo.Dtb)
+	if len(names) == 0 {
+		return []string{modules.RunningDtb}, nil
+	}
+
+	var dtbs []string
+	for _, name := range names {
+		path, err := modules.FindDtb(name)
+		if err != nil {
+			return nil, err
+		}
+		dtbs = append(dtbs, path)
+	}
+	return dtbs, nil
+}
+
+// checkKernelConfig returns an error for each setting in deviceinfo that a
+// kernel with the given config can't use: the compression of the initramfs,
+// which the kernel extracts, and the firmware compression formats, if they
+// are set in deviceinfo. The initramfs-extra is extracted by the init script,
+// and modules are checked once they are selected, see
+// modules.KernelSupport.
+func checkKernelConfig(config osutil.KernelConfig, devinfo deviceinfo.DeviceInfo, firmwareSupport []string) error {
+	var errs []error
+
+	format, _ := archive.ExtractFormatLevel(devinfo.InitfsCompression)
+	if err := archive.KernelSupport(format, config); err != nil {
+		errs = append(errs, err)
+	}
+
+	kernelFirmwareSupport := archive.FirmwareSupport(config)
+	for _, ext := range firmwareSupport {
+		if !slices.Contains(kernelFirmwareSupport, ext) {
+			errs = append(errs, fmt.Errorf("deviceinfo_firmware_compression_support lists %q, but the kernel can't load firmware compressed with it", strings.TrimPrefix(ext, ".")))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// addModulesMetadata adds modules.dep and the other module metadata files to
+// the archive, along with the modprobe.d configuration for the modules,
+// describing the modules in the archive and in the other given files. The
+// order to load the modules in the archive in is written to a file with the
+// given name in the modules dir. Module dependencies and the modprobe.d
+// configuration are read with the given config.
+func addModulesMetadata(config *modules.Config, ar *archive.Archive, otherFiles []string, orderName string) error {
+	order, err := modules.GenerateLoadOrder(config, ar.FileOrigins(), orderName)
+	if err != nil {
+		return err
+	}
+
+	files := append(ar.Files(), otherFiles...)
+	generated, err := modules.GenerateMetadata(files)
+	if err != nil {
+		return err
+	}
+	for path, data := range generated {
+		if err := ar.AddData(path, data, 0644, "(generated module metadata)"); err != nil {
+			return err
+		}
+	}
+
+	for path, data := range order {
+		if err := ar.AddData(path, data, 0644, "(generated module load order)"); err != nil {
+			return err
+		}
+	}
+
+	conf, err := modules.GenerateModprobeConfig(config, files)
+	if err != nil {
+		return err
+	}
+	if conf != nil {
+		if err := ar.AddData("/etc/modprobe.d/mkinitfs.conf", conf, 0644, "(generated modprobe.d configuration)"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processArchive writes the archive to the given path, and optionally
+// verifies it, or if a command was given, runs it on the archive instead
+func processArchive(command string, ar *archive.Archive, path string, verify bool, sizeReportLen int) error {
+	switch command {
+	case "size":
+		return sizeReport(ar, sizeReportLen)
+	case "bench":
+		return benchReport(ar)
+	}
+
+	if err := ar.Write(path, os.FileMode(0644)); err != nil {
+		return err
+	}
+	if verify {
+		log.Print("- Verifying archive")
+		defer misc.TimeFunc(time.Now(), "verify")
+		if err := ar.Verify(path); err != nil {
+			return fmt.Errorf("archive verification failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// sizeReport prints a breakdown of what contributes to the size of the given
+// archive, including the n largest files
+func sizeReport(ar *archive.Archive, n int) error {
+	sizes, err := ar.Sizes()
+	if err != nil {
+		return err
+	}
+	return archive.WriteSizeReport(os.Stdout, sizes, n)
+}
+
+// benchReport compresses the archive with every supported compression format
+// and level, and prints the results
+func benchReport(ar *archive.Archive) error {
+	payload, err := ar.Payload()
+	if err != nil {
+		return err
+	}
+	log.Printf("- Uncompressed size: %s", archive.FormatSize(int64(len(payload))))
+
+	var results []archive.BenchResult
+	for _, c := range archive.BenchFormats() {
+		log.Printf("- Benchmarking %s:%s", c.Format, c.Level)
+		result, err := archive.Bench(payload, c.Format, c.Level)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+
+	return archive.WriteBenchReport(os.Stdout, int64(len(payload)), results)
+}
+
 func bootDeploy(workDir string, outDir string, devinfo deviceinfo.DeviceInfo) error {
 	log.Print("== Using boot-deploy to finalize/install files ==")
 	defer misc.TimeFunc(time.Now(), "boot-deploy")
@@ -6,6 +6,7 @@ package archive
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
@@ -46,28 +47,58 @@ const (
 )
 
 type Archive struct {
-	cpioWriter      *cpio.Writer
 	buf             *bytes.Buffer
 	compress_format CompressFormat
 	compress_level  CompressLevel
+	output_format   OutputFormat
 	items           archiveItems
+	transforms      []Transform
+	// what was written by the last call to writeItems, used by Verify
+	manifest map[string]manifestEntry
+}
+
+// Transform is used to rewrite the contents of regular files as they are
+// copied into the archive. The source files are never modified.
+type Transform interface {
+	// Match returns true if the transform should be applied to the given file
+	Match(f filelist.File) bool
+	// Apply returns the new contents for the file
+	Apply(f filelist.File, data []byte) ([]byte, error)
+}
+
+// Renamer can be implemented by a Transform that also changes the destination
+// path of files in the archive, e.g. if the file extension is changed.
+type Renamer interface {
+	// Rename returns the new destination path for the given file
+	Rename(f filelist.File) string
 }
 
 func New(format CompressFormat, level CompressLevel) *Archive {
 	buf := new(bytes.Buffer)
 	archive := &Archive{
-		cpioWriter:      cpio.NewWriter(buf),
 		buf:             buf,
 		compress_format: format,
 		compress_level:  level,
+		output_format:   OutputCpio,
 	}
 
 	return archive
 }
 
+// AddTransform adds a Transform that is applied to files when the archive is
+// written. Transforms are applied in the order they are added, and must be
+// added before any items are added to the archive.
+func (archive *Archive) AddTransform(t Transform) {
+	archive.transforms = append(archive.transforms, t)
+}
+
 type archiveItem struct {
 	header     *cpio.Header
 	sourcePath string
+	attrs      filelist.Attributes
+	origin     string
+	// contents for items that don't come from a file, see AddData
+	data []byte
 }
 
 type archiveItems struct {
@@ -118,7 +149,9 @@ func ExtractFormatLevel(s string) (format CompressFormat, level CompressLevel) {
 }
 
 // Adds the given item to the archiveItems, only if it doesn't already exist in
-// the list. The items are kept sorted in ascending order.
+// the list. Items with contents in data, e.g. generated files, take precedence
+// and replace an existing item from a file with the same name. The items are
+// kept sorted in ascending order.
 func (a *archiveItems) add(item archiveItem) {
 	a.Lock()
 	defer a.Unlock()
@@ -142,6 +175,9 @@ func (a *archiveItems) add(item archiveItem) {
 
 	if strings.Compare(a.items[i].header.Name, item.header.Name) == 0 {
 		// already in list
+		if item.data != nil && a.items[i].data == nil {
+			a.items[i] = item
+		}
 		return
 	}
 
@@ -166,12 +202,29 @@ func (a *archiveItems) IterItems() <-chan archiveItem {
 	return ch
 }
 
+// SetOutputFormat sets the format that Write uses for the archive. The default
+// is OutputCpio.
+func (archive *Archive) SetOutputFormat(format OutputFormat) {
+	archive.output_format = format
+}
+
 func (archive *Archive) Write(path string, mode os.FileMode) error {
-	if err := archive.writeCpio(); err != nil {
+	var writer OutputWriter
+	switch archive.output_format {
+	case OutputDir:
+		// written directly to path, without compression
+		return archive.writeDir(path)
+	case OutputTar:
+		writer = newTarWriter(archive.buf)
+	default:
+		writer = cpio.NewWriter(archive.buf)
+	}
+
+	if err := archive.writeItems(writer); err != nil {
 		return err
 	}
 
-	if err := archive.cpioWriter.Close(); err != nil {
+	if err := writer.Close(); err != nil {
 		return fmt.Errorf("archive.Write: error closing archive: %w", err)
 	}
 
@@ -187,6 +240,43 @@ func (archive *Archive) Write(path string, mode os.FileMode) error {
 	return nil
 }
 
+// writeDir writes the archive as a directory tree at path. The tree is
+// written to a temporary directory next to path first, which then replaces
+// anything that is at path, so that an existing tree is only replaced by a
+// complete one.
+func (archive *Archive) writeDir(path string) error {
+	tmp, err := os.MkdirTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return fmt.Errorf("archive.Write: unable to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := filepath.Join(tmp, "root")
+	dw, err := newDirWriter(root)
+	if err != nil {
+		return fmt.Errorf("archive.Write: %w", err)
+	}
+	if err := archive.writeItems(dw); err != nil {
+		dw.Close()
+		return err
+	}
+	if err := dw.Close(); err != nil {
+		return err
+	}
+
+	// move the old tree out of the way, it's removed along with tmp
+	if _, err := os.Lstat(path); err == nil {
+		if err := os.Rename(path, filepath.Join(tmp, "old")); err != nil {
+			return fmt.Errorf("archive.Write: unable to replace %q: %w", path, err)
+		}
+	}
+	if err := os.Rename(root, path); err != nil {
+		return fmt.Errorf("archive.Write: unable to move output to %q: %w", path, err)
+	}
+
+	return nil
+}
+
 // AddItems adds the given items in the map to the archive. The map format is
 // {source path:dest path}. Internally this just calls AddItem on each
 // key,value pair in the map.
@@ -196,7 +286,7 @@ func (archive *Archive) AddItems(flister filelist.FileLister) error {
 		return err
 	}
 	for i := range list.IterItems() {
-		if err := archive.AddItem(i.Source, i.Dest); err != nil {
+		if err := archive.addItem(i); err != nil {
 			return err
 		}
 	}
@@ -226,7 +316,7 @@ func (archive *Archive) AddItemsExclude(flister filelist.FileLister, exclude fil
 		}
 
 		if !found {
-			if err := archive.AddItem(i.Source, i.Dest); err != nil {
+			if err := archive.addItem(i); err != nil {
 				return err
 			}
 		}
@@ -237,10 +327,89 @@ func (archive *Archive) AddItemsExclude(flister filelist.FileLister, exclude fil
 
 // Adds the given file or directory at "source" to the archive at "dest"
 func (archive *Archive) AddItem(source string, dest string) error {
+	return archive.addItem(filelist.File{
+		Source: source,
+		Dest:   dest,
+	})
+}
+
+// AddData adds a regular file with the given contents to the archive at dest.
+// Transforms aren't applied to it. origin is shown in size reports, see
+// Archive.Sizes.
+func (archive *Archive) AddData(dest string, data []byte, mode os.FileMode, origin string) error {
 	if osutil.HasMergedUsr() {
-		source = osutil.MergeUsr(source)
 		dest = osutil.MergeUsr(dest)
 	}
+	if data == nil {
+		data = []byte{}
+	}
+	return archive.addData(filelist.File{
+		Dest:   dest,
+		Data:   data,
+		Attrs:  filelist.Attributes{Mode: mode, HasMode: true},
+		Origin: origin,
+	})
+}
+
+// addData adds a File that has its contents in Data. The file's mode is 0644,
+// unless its attributes override it.
+func (archive *Archive) addData(f filelist.File) error {
+	if err := archive.addDir(filepath.Dir(f.Dest)); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if f.Attrs.HasMode {
+		mode = f.Attrs.Mode
+	}
+	header := &cpio.Header{
+		Name: strings.TrimPrefix(f.Dest, "/"),
+		Mode: cpio.TypeReg | cpio.FileMode(mode.Perm()),
+		Size: int64(len(f.Data)),
+	}
+	setOwner(header, f.Attrs)
+	archive.items.add(archiveItem{
+		attrs:  f.Attrs,
+		origin: f.Origin,
+		data:   f.Data,
+		header: header,
+	})
+
+	return nil
+}
+
+// Files returns the paths of all regular files and symlinks in the archive
+func (archive *Archive) Files() (files []string) {
+	for item := range archive.items.IterItems() {
+		if !item.header.Mode.IsDir() {
+			files = append(files, "/"+item.header.Name)
+		}
+	}
+	return
+}
+
+// FileOrigins returns the origin of each regular file and symlink in the
+// archive, by path like in Files
+func (archive *Archive) FileOrigins() map[string]string {
+	origins := make(map[string]string)
+	for item := range archive.items.IterItems() {
+		if !item.header.Mode.IsDir() {
+			origins["/"+item.header.Name] = item.origin
+		}
+	}
+	return origins
+}
+
+func (archive *Archive) addItem(f filelist.File) error {
+	if osutil.HasMergedUsr() {
+		f.Source = osutil.MergeUsr(f.Source)
+		f.Dest = osutil.MergeUsr(f.Dest)
+	}
+	if f.Data != nil {
+		return archive.addData(f)
+	}
+	source := f.Source
+	dest := f.Dest
 	sourceStat, err := os.Lstat(source)
 	if err != nil {
 		e, ok := err.(*os.PathError)
@@ -254,17 +423,20 @@ func (archive *Archive) AddItem(source string, dest string) error {
 	// A symlink to a directory doesn't have the os.ModeDir bit set, so we need
 	// to check if it's a symlink first
 	if sourceStat.Mode()&os.ModeSymlink != 0 {
-		return archive.addSymlink(source, dest)
+		return archive.addSymlink(f)
 	}
 
 	if sourceStat.Mode()&os.ModeDir != 0 {
 		return archive.addDir(dest)
 	}
 
-	return archive.addFile(source, dest)
+	return archive.addFile(f)
 }
 
-func (archive *Archive) addSymlink(source string, dest string) error {
+func (archive *Archive) addSymlink(f filelist.File) error {
+	source := f.Source
+	dest := f.Dest
+
 	// Make sure the symlink's parent dir exists in the archive
 	if err := archive.addDir(filepath.Dir(dest)); err != nil {
 		return err
@@ -290,25 +462,44 @@ func (archive *Archive) addSymlink(source string, dest string) error {
 		}
 	}
 
-	archive.AddItem(targetAbs, targetAbs)
+	if !f.Attrs.NoFollow {
+		archive.addItem(filelist.File{
+			Source: targetAbs,
+			Dest:   targetAbs,
+			Attrs:  f.Attrs,
+			Origin: f.Origin,
+		})
+	}
 
 	// Now add the symlink itself
 	destFilename := strings.TrimPrefix(dest, "/")
 
+	header := &cpio.Header{
+		Name:     destFilename,
+		Linkname: target,
+		Mode:     0644 | cpio.TypeSymlink,
+		Size:     int64(len(target)),
+	}
+	setOwner(header, f.Attrs)
 	archive.items.add(archiveItem{
 		sourcePath: source,
-		header: &cpio.Header{
-			Name:     destFilename,
-			Linkname: target,
-			Mode:     0644 | cpio.TypeSymlink,
-			Size:     int64(len(target)),
-		},
+		attrs:      f.Attrs,
+		origin:     f.Origin,
+		header:     header,
 	})
 
 	return nil
 }
 
-func (archive *Archive) addFile(source string, dest string) error {
+func (archive *Archive) addFile(f filelist.File) error {
+	for _, t := range archive.transforms {
+		if r, ok := t.(Renamer); ok && !f.Attrs.NoTransform {
+			f.Dest = r.Rename(f)
+		}
+	}
+	source := f.Source
+	dest := f.Dest
+
 	if err := archive.addDir(filepath.Dir(dest)); err != nil {
 		return err
 	}
@@ -321,153 +512,249 @@ func (archive *Archive) addFile(source string, dest string) error {
 
 	destFilename := strings.TrimPrefix(dest, "/")
 
+	mode := sourceStat.Mode().Perm()
+	if f.Attrs.HasMode {
+		mode = f.Attrs.Mode
+	}
+	header := &cpio.Header{
+		Name: destFilename,
+		Mode: cpio.TypeReg | cpio.FileMode(mode.Perm()),
+		Size: sourceStat.Size(),
+		// Checksum: 1,
+	}
+	setOwner(header, f.Attrs)
 	archive.items.add(archiveItem{
 		sourcePath: source,
-		header: &cpio.Header{
-			Name: destFilename,
-			Mode: cpio.FileMode(sourceStat.Mode().Perm()),
-			Size: sourceStat.Size(),
-			// Checksum: 1,
-		},
+		attrs:      f.Attrs,
+		origin:     f.Origin,
+		header:     header,
 	})
 
 	return nil
 }
 
-func (archive *Archive) writeCompressed(path string, mode os.FileMode) (err error) {
+// setOwner sets the owner of the given header, if the attributes override it.
+func setOwner(header *cpio.Header, attrs filelist.Attributes) {
+	if attrs.HasOwner {
+		header.Uid = attrs.Uid
+		header.Guid = attrs.Gid
+	}
+}
 
-	var compressor io.WriteCloser
+func (archive *Archive) writeCompressed(path string, mode os.FileMode) (err error) {
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
 	defer func() {
-		e := compressor.Close()
+		e := fd.Close()
 		if e != nil && err == nil {
 			err = e
 		}
 	}()
 
-	fd, err := os.Create(path)
+	compressor, err := newCompressor(fd, archive.compress_format, archive.compress_level)
 	if err != nil {
 		return err
 	}
-	// Note: fd.Close omitted since it'll be closed in "compressor"
 
-	switch archive.compress_format {
+	if _, err = io.Copy(compressor, archive.buf); err != nil {
+		return err
+	}
+
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+
+	// call fsync just to be sure
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressor returns a WriteCloser that compresses everything written to it
+// with the given format and level, and writes it to w. Close must be called to
+// flush any buffered data, but it doesn't close w.
+func newCompressor(w io.Writer, format CompressFormat, level CompressLevel) (io.WriteCloser, error) {
+	switch format {
 	case FormatGzip:
-		level := gzip.DefaultCompression
-		switch archive.compress_level {
+		gzipLevel := gzip.DefaultCompression
+		switch level {
 		case LevelBest:
-			level = gzip.BestCompression
+			gzipLevel = gzip.BestCompression
 		case LevelFast:
-			level = gzip.BestSpeed
-		}
-		compressor, err = gzip.NewWriterLevel(fd, level)
-		if err != nil {
-			return err
+			gzipLevel = gzip.BestSpeed
 		}
+		return gzip.NewWriterLevel(w, gzipLevel)
 	case FormatLzma:
-		compressor, err = xz.NewWriter(fd)
-		if err != nil {
-			return err
-		}
+		return xz.NewWriter(w)
 	case FormatLz4:
 		// The default compression for the lz4 library is Fast, and
 		// they don't define a Default level otherwise
-		level := lz4.Fast
-		switch archive.compress_level {
+		lz4Level := lz4.Fast
+		switch level {
 		case LevelBest:
-			level = lz4.Level9
+			lz4Level = lz4.Level9
 		case LevelFast:
-			level = lz4.Fast
+			lz4Level = lz4.Fast
 		}
 
-		var writer = lz4.NewWriter(fd)
-		err = writer.Apply(lz4.LegacyOption(true), lz4.CompressionLevelOption(level))
+		var writer = lz4.NewWriter(w)
+		err := writer.Apply(lz4.LegacyOption(true), lz4.CompressionLevelOption(lz4Level))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		compressor = writer
+		return writer, nil
 	case FormatNone:
-		compressor = fd
+		return nopWriteCloser{w}, nil
 	case FormatZstd:
-		level := zstd.SpeedDefault
-		switch archive.compress_level {
+		zstdLevel := zstd.SpeedDefault
+		switch level {
 		case LevelBest:
-			level = zstd.SpeedBestCompression
+			zstdLevel = zstd.SpeedBestCompression
 		case LevelFast:
-			level = zstd.SpeedFastest
-		}
-		compressor, err = zstd.NewWriter(fd, zstd.WithEncoderLevel(level))
-		if err != nil {
-			return err
+			zstdLevel = zstd.SpeedFastest
 		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel))
 	default:
 		log.Print("Unknown or no compression format set, using gzip")
-		compressor = gzip.NewWriter(fd)
+		return gzip.NewWriter(w), nil
 	}
-
-	if _, err = io.Copy(compressor, archive.buf); err != nil {
-		return err
-	}
-
-	// call fsync just to be sure
-	if err := fd.Sync(); err != nil {
-		return err
-	}
-
-	if err := os.Chmod(path, mode); err != nil {
-		return err
-	}
-
-	return nil
 }
 
-func (archive *Archive) writeCpio() error {
+// writeItems writes all items in the archive using the given OutputWriter
+func (archive *Archive) writeItems(writer OutputWriter) error {
 	// Just in case
 	if osutil.HasMergedUsr() {
-		archive.addSymlink("/bin", "/bin")
-		archive.addSymlink("/sbin", "/sbin")
-		archive.addSymlink("/lib", "/lib")
+		for _, dir := range []string{"/bin", "/sbin", "/lib"} {
+			archive.addSymlink(filelist.File{
+				Source: dir,
+				Dest:   dir,
+			})
+		}
 	}
+	archive.manifest = make(map[string]manifestEntry)
+
 	// having a transient function for actually adding files to the archive
 	// allows the deferred fd.close to run after every copy and prevent having
 	// tons of open file handles until the copying is all done
-	copyToArchive := func(source string, header *cpio.Header) error {
+	copyToArchive := func(item archiveItem) error {
+		source := item.sourcePath
+		header := item.header
+
+		// transformed file contents are buffered in memory, since the
+		// header must have the new size before the contents can be written
+		var data []byte
+		if header.Mode.IsRegular() {
+			var err error
+			if data, err = archive.transform(item); err != nil {
+				return fmt.Errorf("archive.writeItems: unable to transform %q: %w", source, err)
+			}
+			if data != nil {
+				header.Size = int64(len(data))
+			}
+		}
 
-		if err := archive.cpioWriter.WriteHeader(header); err != nil {
-			return fmt.Errorf("archive.writeCpio: unable to write header: %w", err)
+		if err := writer.WriteHeader(header); err != nil {
+			return fmt.Errorf("archive.writeItems: unable to write header: %w", err)
 		}
 
+		// everything written for the item is also hashed, for Verify
+		entry := manifestEntry{mode: header.Mode &^ cpio.ModePerm}
+		hash := sha256.New()
+		out := io.MultiWriter(writer, hash)
+
 		// don't copy actual dirs into the archive, writing the header is enough
 		if !header.Mode.IsDir() {
-			if header.Mode.IsRegular() {
+			if data != nil {
+				if _, err := out.Write(data); err != nil {
+					return fmt.Errorf("archive.writeItems: Couldn't process %q: %w", source, err)
+				}
+				entry.size = int64(len(data))
+			} else if header.Mode.IsRegular() {
 				fd, err := os.Open(source)
 				if err != nil {
-					return fmt.Errorf("archive.writeCpio: Unable to open file %q, %w", source, err)
+					return fmt.Errorf("archive.writeItems: Unable to open file %q, %w", source, err)
 				}
 				defer fd.Close()
-				if _, err := io.Copy(archive.cpioWriter, fd); err != nil {
-					return fmt.Errorf("archive.writeCpio: Couldn't process %q: %w", source, err)
+				if entry.size, err = io.Copy(out, fd); err != nil {
+					return fmt.Errorf("archive.writeItems: Couldn't process %q: %w", source, err)
 				}
 			} else if header.Linkname != "" {
 				// the contents of a symlink is just need the link name
-				if _, err := archive.cpioWriter.Write([]byte(header.Linkname)); err != nil {
-					return fmt.Errorf("archive.writeCpio: unable to write out symlink: %q -> %q: %w", source, header.Linkname, err)
+				entry.size = int64(len(header.Linkname))
+				if _, err := out.Write([]byte(header.Linkname)); err != nil {
+					return fmt.Errorf("archive.writeItems: unable to write out symlink: %q -> %q: %w", source, header.Linkname, err)
 				}
 			} else {
-				return fmt.Errorf("archive.writeCpio: unknown type for file: %q: %d", source, header.Mode)
+				return fmt.Errorf("archive.writeItems: unknown type for file: %q: %d", source, header.Mode)
 			}
 		}
 
+		copy(entry.sum[:], hash.Sum(nil))
+		archive.manifest[header.Name] = entry
+
 		return nil
 	}
 
 	for i := range archive.items.IterItems() {
-		if err := copyToArchive(i.sourcePath, i.header); err != nil {
+		if err := copyToArchive(i); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// transform runs all matching transforms on the given item, and returns the
+// resulting contents. If no transforms apply, then nil is returned. Items added
+// with AddData are returned as-is, and items with the NoTransform attribute
+// aren't transformed.
+func (archive *Archive) transform(item archiveItem) ([]byte, error) {
+	if item.data != nil {
+		return item.data, nil
+	}
+	if item.attrs.NoTransform {
+		return nil, nil
+	}
+
+	f := filelist.File{
+		Source: item.sourcePath,
+		Dest:   "/" + item.header.Name,
+		Attrs:  item.attrs,
+	}
+
+	var data []byte
+	for _, t := range archive.transforms {
+		if !t.Match(f) {
+			continue
+		}
+		if data == nil {
+			var err error
+			if data, err = os.ReadFile(f.Source); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if data, err = t.Apply(f, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
 func (archive *Archive) addDir(dir string) error {
 	if dir == "/" {
 		dir = "."
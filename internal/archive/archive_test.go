@@ -4,10 +4,24 @@
 package archive
 
 import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/cavaliergopher/cpio"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
 )
 
 func TestArchiveItemsAdd(t *testing.T) {
@@ -175,6 +189,44 @@ func TestArchiveItemsAdd(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "data replaces file",
+			inItems: []archiveItem{
+				{
+					sourcePath: "/etc/hostname",
+					header:     &cpio.Header{Name: "/etc/hostname"},
+				},
+			},
+			inItem: archiveItem{
+				header: &cpio.Header{Name: "/etc/hostname"},
+				data:   []byte("generated"),
+			},
+			expected: []archiveItem{
+				{
+					header: &cpio.Header{Name: "/etc/hostname"},
+					data:   []byte("generated"),
+				},
+			},
+		},
+		{
+			name: "file doesn't replace data",
+			inItems: []archiveItem{
+				{
+					header: &cpio.Header{Name: "/etc/hostname"},
+					data:   []byte("generated"),
+				},
+			},
+			inItem: archiveItem{
+				sourcePath: "/etc/hostname",
+				header:     &cpio.Header{Name: "/etc/hostname"},
+			},
+			expected: []archiveItem{
+				{
+					header: &cpio.Header{Name: "/etc/hostname"},
+					data:   []byte("generated"),
+				},
+			},
+		},
 	}
 
 	for _, st := range subtests {
@@ -276,3 +328,729 @@ func TestExtractFormatLevel(t *testing.T) {
 		})
 	}
 }
+
+func TestStripDebug(t *testing.T) {
+	// files are copied to a temp dir, since the archive keeps the path of
+	// the source file
+	srcDir := t.TempDir()
+	hello, err := os.ReadFile("./test_resources/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"strip", "nostrip"} {
+		if err := os.WriteFile(filepath.Join(srcDir, name), hello, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := New(FormatNone, LevelDefault)
+	a.AddTransform(NewStripDebug(true))
+	if err := a.AddItem(filepath.Join(srcDir, "strip"), "/opt/strip"); err != nil {
+		t.Fatal(err)
+	}
+	err = a.addItem(filelist.File{
+		Source: filepath.Join(srcDir, "nostrip"),
+		Dest:   "/opt/nostrip",
+		Attrs:  filelist.Attributes{Strip: filelist.StripNever},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "initramfs")
+	if err := a.Write(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := readCpio(t, path)
+	if !bytes.Equal(out["opt/nostrip"], hello) {
+		t.Error("expected file with StripNever to be unchanged")
+	}
+	f, err := elf.NewFile(bytes.NewReader(out["opt/strip"]))
+	if err != nil {
+		t.Fatal("unable to parse stripped file: ", err)
+	}
+	if f.Section(".symtab") != nil {
+		t.Error("expected file in archive to be stripped")
+	}
+}
+
+// readCpio returns the contents of all regular files in the given
+// uncompressed cpio archive
+func readCpio(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	files := make(map[string][]byte)
+	r := cpio.NewReader(fd)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("unable to read archive: ", err)
+		}
+		if !hdr.Mode.IsRegular() {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal("unable to read archive: ", err)
+		}
+		files[hdr.Name] = data
+	}
+	return files
+}
+
+func TestStripELF(t *testing.T) {
+	// A small executable with debug info and a symbol table to strip, see
+	// test_resources/hello.c
+	data, err := os.ReadFile("./test_resources/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := stripELF(data)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if len(out) >= len(data) {
+		t.Errorf("expected stripped file to be smaller, got %d, original %d", len(out), len(data))
+	}
+
+	stripped, err := elf.NewFile(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("unable to parse stripped file: ", err)
+	}
+	for _, s := range stripped.Sections {
+		if s.Type == elf.SHT_SYMTAB || strings.HasPrefix(s.Name, ".debug") {
+			t.Errorf("section %q was not removed", s.Name)
+		}
+	}
+	if stripped.Section(".text") == nil {
+		t.Error("section .text is missing")
+	}
+
+	// Program segments must be untouched, except for the section header
+	// fields in the ELF header
+	orig, _ := elf.NewFile(bytes.NewReader(data))
+	for i, p := range orig.Progs {
+		start := p.Off
+		if start == 0 {
+			start = 64
+		}
+		if p.Off+p.Filesz <= start {
+			continue
+		}
+		a := data[start : p.Off+p.Filesz]
+		b := out[start : stripped.Progs[i].Off+stripped.Progs[i].Filesz]
+		if !bytes.Equal(a, b) {
+			t.Errorf("contents of program segment %d changed", i)
+		}
+	}
+
+	// And it should still run
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		return
+	}
+	bin := filepath.Join(t.TempDir(), "stripped")
+	if err := os.WriteFile(bin, out, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(bin).Run(); err != nil {
+		t.Error("unable to run stripped binary: ", err)
+	}
+}
+
+func TestDecompressFirmware(t *testing.T) {
+	firmware := []byte("some firmware blob")
+	compressed, err := misc.Compress(misc.ExtZstd, firmware)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.bin.zst", "b.bin.zst"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), compressed, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destDir := "/lib/firmware/vendor"
+	if osutil.HasMergedUsr() {
+		destDir = osutil.MergeUsr(destDir)
+	}
+	tables := []struct {
+		name      string
+		supported []string
+		expected  map[string][]byte
+	}{
+		{"kernel supports zstd", []string{misc.ExtXz, misc.ExtZstd}, map[string][]byte{
+			"a.bin.zst": compressed,
+			"b.bin.zst": compressed,
+		}},
+		{"kernel supports xz", []string{misc.ExtXz}, map[string][]byte{
+			"a.bin": firmware,
+			"b.bin": firmware,
+		}},
+		{"kernel doesn't support compression", nil, map[string][]byte{
+			"a.bin": firmware,
+			"b.bin": firmware,
+		}},
+	}
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			a := New(FormatNone, LevelDefault)
+			a.AddTransform(NewDecompressFirmware(table.supported))
+			for _, name := range []string{"a.bin.zst", "b.bin.zst"} {
+				if err := a.AddItem(filepath.Join(tmpDir, name), filepath.Join(destDir, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out := filepath.Join(t.TempDir(), "initramfs")
+			if err := a.Write(out, 0644); err != nil {
+				t.Fatal(err)
+			}
+			files := readCpio(t, out)
+			for name, expected := range table.expected {
+				got, found := files[strings.TrimPrefix(filepath.Join(destDir, name), "/")]
+				if !found {
+					t.Errorf("%q not found in archive", name)
+				} else if !bytes.Equal(got, expected) {
+					t.Errorf("%q has unexpected contents: %q", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	newArchive := func(format OutputFormat) *Archive {
+		a := New(FormatNone, LevelDefault)
+		a.SetOutputFormat(format)
+		if err := a.AddItem(filepath.Join(srcDir, "file"), "/foo/file"); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddItem(filepath.Join(srcDir, "link"), "/foo/link"); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddItem("/this/does/not/exist", "/bar/bazz"); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	t.Run("dir", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "initramfs")
+		if err := newArchive(OutputDir).Write(out, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(filepath.Join(out, "foo/file")); err != nil {
+			t.Error(err)
+		} else if string(data) != "hello" {
+			t.Errorf("unexpected contents: %q", data)
+		}
+		if stat, err := os.Stat(filepath.Join(out, "foo/file")); err != nil {
+			t.Error(err)
+		} else if stat.Mode().Perm() != 0600 {
+			t.Errorf("unexpected mode: %s", stat.Mode())
+		}
+		if target, err := os.Readlink(filepath.Join(out, "foo/link")); err != nil {
+			t.Error(err)
+		} else if target != "file" {
+			t.Errorf("unexpected symlink target: %q", target)
+		}
+		if stat, err := os.Stat(filepath.Join(out, "bar/bazz")); err != nil {
+			t.Error(err)
+		} else if !stat.IsDir() {
+			t.Error("expected a directory")
+		}
+
+		// Existing directories are replaced, including files that aren't in
+		// the new archive
+		stale := filepath.Join(out, "stale")
+		if err := os.WriteFile(stale, []byte("stale"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := newArchive(OutputDir).Write(out, 0644); err != nil {
+			t.Fatal("unable to replace existing output directory: ", err)
+		}
+		if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+			t.Error("expected stale file to be removed, got: ", err)
+		}
+		if data, err := os.ReadFile(filepath.Join(out, "foo/file")); err != nil || string(data) != "hello" {
+			t.Errorf("expected replaced directory to have the archive contents, got: %q, %v", data, err)
+		}
+		// temporary directories are cleaned up
+		if entries, err := os.ReadDir(filepath.Dir(out)); err != nil || len(entries) != 1 {
+			t.Errorf("expected only the output directory to be left, got: %v, %v", entries, err)
+		}
+	})
+
+	t.Run("tar", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "initramfs")
+		if err := newArchive(OutputTar).Write(out, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fd, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+
+		found := make(map[string]*tar.Header)
+		r := tar.NewReader(fd)
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			found[strings.TrimSuffix(hdr.Name, "/")] = hdr
+			if hdr.Name == "foo/file" {
+				if data, _ := io.ReadAll(r); string(data) != "hello" {
+					t.Errorf("unexpected contents: %q", data)
+				}
+			}
+		}
+		if hdr, ok := found["foo/file"]; !ok || hdr.Typeflag != tar.TypeReg || hdr.Mode != 0600 {
+			t.Errorf("unexpected header for foo/file: %+v", hdr)
+		}
+		if hdr, ok := found["foo/link"]; !ok || hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "file" {
+			t.Errorf("unexpected header for foo/link: %+v", hdr)
+		}
+		if hdr, ok := found["bar/bazz"]; !ok || hdr.Typeflag != tar.TypeDir {
+			t.Errorf("unexpected header for bar/bazz: %+v", hdr)
+		}
+	})
+}
+
+func TestSizes(t *testing.T) {
+	srcDir := t.TempDir()
+	files := map[string]int{
+		"big":    10000,
+		"medium": 1000,
+		"small":  10,
+	}
+	a := New(FormatGzip, LevelDefault)
+	for name, size := range files {
+		src := filepath.Join(srcDir, name)
+		if err := os.WriteFile(src, bytes.Repeat([]byte("a"), size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f := filelist.File{
+			Source: src,
+			Dest:   filepath.Join("/foo", name),
+			Origin: "/etc/mkinitfs/files/foo.files",
+		}
+		if name == "small" {
+			f.Dest = "/bar/small"
+			f.Origin = "/etc/mkinitfs/files/bar.files"
+		}
+		if err := a.addItem(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sizes, err := a.Sizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != len(files) {
+		t.Fatalf("expected %d items, got: %+v", len(files), sizes)
+	}
+	for _, s := range sizes {
+		expected := files[filepath.Base(s.Name)]
+		if s.Size != int64(expected) {
+			t.Errorf("%q: expected size %d, got %d", s.Name, expected, s.Size)
+		}
+		if s.Compressed <= 0 || (expected > 100 && s.Compressed >= s.Size) {
+			t.Errorf("%q: unexpected compressed size %d", s.Name, s.Compressed)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := WriteSizeReport(&out, sizes, 2); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+	for _, expected := range []string{"10.8 KiB", "/foo", "/bar", "/etc/mkinitfs/files/foo.files", "/etc/mkinitfs/files/bar.files", "/foo/big", "/foo/medium"} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("expected %q in report:\n%s", expected, report)
+		}
+	}
+	if strings.Contains(report, "/bar/small") {
+		t.Errorf("expected only the 2 largest files in report:\n%s", report)
+	}
+	t.Log("\n" + report)
+}
+
+func TestBench(t *testing.T) {
+	srcDir := t.TempDir()
+	a := New(FormatNone, LevelDefault)
+	for i := 0; i < 10; i++ {
+		src := filepath.Join(srcDir, fmt.Sprintf("file%d", i))
+		data := bytes.Repeat([]byte(fmt.Sprintf("some data %d ", i)), 1000)
+		if err := os.WriteFile(src, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddItem(src, filepath.Join("/foo", filepath.Base(src))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payload, err := a.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []BenchResult
+	for _, c := range BenchFormats() {
+		result, err := Bench(payload, c.Format, c.Level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Format == FormatNone {
+			if result.Size != int64(len(payload)) {
+				t.Errorf("expected uncompressed size %d, got %d", len(payload), result.Size)
+			}
+		} else if result.Size >= int64(len(payload)) {
+			t.Errorf("%s:%s: expected size < %d, got %d", c.Format, c.Level, len(payload), result.Size)
+		}
+		results = append(results, result)
+	}
+
+	var out bytes.Buffer
+	if err := WriteBenchReport(&out, int64(len(payload)), results); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range BenchFormats() {
+		if !strings.Contains(out.String(), fmt.Sprintf("%s:%s", c.Format, c.Level)) {
+			t.Errorf("expected %s:%s in report:\n%s", c.Format, c.Level, out.String())
+		}
+	}
+	t.Log("\n" + out.String())
+}
+
+func TestVerify(t *testing.T) {
+	newArchive := func(t *testing.T, format CompressFormat, output OutputFormat) *Archive {
+		srcDir := t.TempDir()
+		a := New(format, LevelDefault)
+		a.SetOutputFormat(output)
+		for i := 0; i < 5; i++ {
+			src := filepath.Join(srcDir, fmt.Sprintf("file%d", i))
+			if err := os.WriteFile(src, bytes.Repeat([]byte{byte(i)}, 1000*i), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.AddItem(src, filepath.Join("/foo/bar", filepath.Base(src))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		link := filepath.Join(srcDir, "link")
+		if err := os.Symlink("file1", link); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddItem(link, "/foo/bar/link"); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	for _, output := range []OutputFormat{OutputCpio, OutputTar, OutputDir} {
+		for _, format := range []CompressFormat{FormatNone, FormatGzip, FormatLz4, FormatLzma, FormatZstd} {
+			if output == OutputDir && format != FormatNone {
+				continue
+			}
+			t.Run(fmt.Sprintf("%s-%s", output, format), func(t *testing.T) {
+				a := newArchive(t, format, output)
+				path := filepath.Join(t.TempDir(), "initramfs")
+				if err := a.Write(path, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := a.Verify(path); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, format := range []CompressFormat{FormatNone, FormatGzip, FormatLz4, FormatLzma, FormatZstd} {
+			a := newArchive(t, format, OutputCpio)
+			path := filepath.Join(t.TempDir(), "initramfs")
+			if err := a.Write(path, 0644); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(path, info.Size()/2); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Verify(path); err == nil {
+				t.Errorf("%s: expected error verifying truncated archive", format)
+			}
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		a := newArchive(t, FormatNone, OutputDir)
+		path := filepath.Join(t.TempDir(), "initramfs")
+		if err := a.Write(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "foo/bar/file2"), bytes.Repeat([]byte{9}, 2000), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Verify(path); err == nil || !strings.Contains(err.Error(), "unexpected contents") {
+			t.Errorf("expected error about contents, got: %v", err)
+		}
+		if err := os.Remove(filepath.Join(path, "foo/bar/file3")); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Verify(path); err == nil {
+			t.Errorf("expected error verifying archive with missing file")
+		}
+	})
+
+	// without the merged /usr symlinks, nothing adds "/" to the archive
+	t.Run("no root", func(t *testing.T) {
+		a := newArchive(t, FormatNone, OutputDir)
+		path := filepath.Join(t.TempDir(), "initramfs")
+		if err := a.Write(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+		delete(a.manifest, ".")
+		for _, dir := range []string{"bin", "sbin", "lib"} {
+			delete(a.manifest, dir)
+			if err := os.RemoveAll(filepath.Join(path, dir)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := a.Verify(path); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestAddData(t *testing.T) {
+	srcDir := t.TempDir()
+	src := filepath.Join(srcDir, "file")
+	if err := os.WriteFile(src, []byte("from a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New(FormatNone, LevelDefault)
+	// transforms aren't applied to in-memory data
+	a.AddTransform(&testTransform{})
+	if err := a.AddItem(src, "/foo/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddData("/foo/bar/generated", []byte("generated"), 0600, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddData("/foo/empty", nil, 0644, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := a.Files()
+	sort.Strings(files)
+	expectedFiles := []string{"/foo/bar/generated", "/foo/empty", "/foo/file"}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("expected files: %q, got: %q", expectedFiles, files)
+	}
+	expectedOrigins := map[string]string{"/foo/bar/generated": "test", "/foo/empty": "test", "/foo/file": ""}
+	if origins := a.FileOrigins(); !reflect.DeepEqual(origins, expectedOrigins) {
+		t.Errorf("expected origins: %q, got: %q", expectedOrigins, origins)
+	}
+
+	path := filepath.Join(t.TempDir(), "initramfs")
+	if err := a.Write(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(path); err != nil {
+		t.Fatal(err)
+	}
+	out := readCpio(t, path)
+	expected := map[string][]byte{
+		"foo/file":          []byte("FROM A FILE"),
+		"foo/bar/generated": []byte("generated"),
+		"foo/empty":         {},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+// testTransform converts the contents of every file to upper case
+type testTransform struct{}
+
+func (t *testTransform) Match(f filelist.File) bool {
+	return true
+}
+
+func (t *testTransform) Apply(f filelist.File, data []byte) ([]byte, error) {
+	return bytes.ToUpper(data), nil
+}
+
+func TestAddItemAttributes(t *testing.T) {
+	srcDir := t.TempDir()
+	for _, name := range []string{"key", "plain", "raw"} {
+		if err := os.WriteFile(filepath.Join(srcDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("target", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "target"), []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New(FormatNone, LevelDefault)
+	a.AddTransform(&testTransform{})
+	for _, f := range []filelist.File{
+		{Source: "key", Attrs: filelist.Attributes{Mode: 0600, HasMode: true, Uid: 1000, Gid: 100, HasOwner: true}},
+		{Source: "plain"},
+		{Source: "raw", Attrs: filelist.Attributes{NoTransform: true}},
+		{Source: "link", Attrs: filelist.Attributes{NoFollow: true, Uid: 5, HasOwner: true}},
+		// generated, so there is no source file
+		{Source: "gen", Data: []byte("generated"), Attrs: filelist.Attributes{Mode: 0600, HasMode: true}},
+	} {
+		f.Dest = "/" + f.Source
+		f.Source = filepath.Join(srcDir, f.Source)
+		if err := a.addItem(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "initramfs")
+	if err := a.Write(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	type entry struct {
+		mode     cpio.FileMode
+		uid, gid int
+		data     string
+	}
+	got := make(map[string]entry)
+	r := cpio.NewReader(fd)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("unable to read archive: ", err)
+		}
+		// skip dirs, and the merged /usr symlinks
+		if hdr.Mode.IsDir() || hdr.Linkname == "usr/"+hdr.Name {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal("unable to read archive: ", err)
+		}
+		if hdr.Linkname != "" {
+			data = []byte(hdr.Linkname)
+		}
+		got[hdr.Name] = entry{hdr.Mode, hdr.Uid, hdr.Guid, string(data)}
+	}
+
+	expected := map[string]entry{
+		"key":   {cpio.TypeReg | 0600, 1000, 100, "KEY"},
+		"plain": {cpio.TypeReg | 0644, 0, 0, "PLAIN"},
+		"raw":   {cpio.TypeReg | 0644, 0, 0, "raw"},
+		// the target of the symlink isn't added
+		"link": {cpio.TypeSymlink | 0644, 5, 0, "target"},
+		"gen":  {cpio.TypeReg | 0600, 0, 0, "generated"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %+v, got: %+v", expected, got)
+	}
+}
+
+func TestAddItemGeneratedPrecedence(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "hostname")
+	if err := os.WriteFile(src, []byte("from a file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a file from a .files list, and a generated file with the same path
+	listed := filelist.File{Source: src, Dest: "/etc/hostname", Origin: "/etc/mkinitfs/files/00-test.files"}
+	generated := filelist.File{Source: "/etc/hostname", Dest: "/etc/hostname", Origin: "/etc/mkinitfs/gen/hostname", Data: []byte("generated\n")}
+
+	tables := []struct {
+		name  string
+		files []filelist.File
+	}{
+		{"listed first", []filelist.File{listed, generated}},
+		{"generated first", []filelist.File{generated, listed}},
+	}
+	for _, table := range tables {
+		a := New(FormatNone, LevelDefault)
+		for _, f := range table.files {
+			if err := a.addItem(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if origin := a.FileOrigins()["/etc/hostname"]; origin != generated.Origin {
+			t.Errorf("%s: expected origin: %q, got: %q", table.name, generated.Origin, origin)
+		}
+
+		path := filepath.Join(t.TempDir(), "initramfs")
+		if err := a.Write(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out := readCpio(t, path)["etc/hostname"]; string(out) != "generated\n" {
+			t.Errorf("%s: expected generated file, got: %q", table.name, out)
+		}
+	}
+}
+
+func TestKernelSupport(t *testing.T) {
+	config := osutil.KernelConfig{
+		"CONFIG_BLK_DEV_INITRD": "y",
+		"CONFIG_RD_GZIP":        "y",
+		"CONFIG_RD_LZ4":         "y",
+	}
+
+	tables := []struct {
+		config   osutil.KernelConfig
+		format   CompressFormat
+		expected bool
+	}{
+		{config, FormatGzip, true},
+		{config, FormatLz4, true},
+		{config, FormatNone, true},
+		{config, FormatZstd, false},
+		{config, FormatLzma, false},
+		// lzma is written in the xz container format
+		{osutil.KernelConfig{"CONFIG_BLK_DEV_INITRD": "y", "CONFIG_RD_XZ": "y"}, FormatLzma, true},
+		{osutil.KernelConfig{"CONFIG_BLK_DEV_INITRD": "y", "CONFIG_RD_LZMA": "y"}, FormatLzma, false},
+		{osutil.KernelConfig{"CONFIG_RD_GZIP": "y"}, FormatGzip, false},
+	}
+	for _, table := range tables {
+		err := KernelSupport(table.format, table.config)
+		if (err == nil) != table.expected {
+			t.Errorf("%v, %s: expected supported: %t, got: %v", table.config, table.format, table.expected, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// BenchResult is the result of compressing an archive with a single
+// compression format and level
+type BenchResult struct {
+	Format CompressFormat
+	Level  CompressLevel
+	// Compressed size
+	Size int64
+	// Time to compress the archive
+	CompressTime time.Duration
+	// Time to decompress the archive, on a single thread
+	DecompressTime time.Duration
+	// Peak heap memory used while compressing
+	CompressMemory uint64
+	// Peak heap memory used while decompressing
+	DecompressMemory uint64
+}
+
+// Compression is a compression format and level
+type Compression struct {
+	Format CompressFormat
+	Level  CompressLevel
+}
+
+// BenchFormats returns every compression format and level combination that
+// the archive can be written with
+func BenchFormats() (formats []Compression) {
+	add := func(format CompressFormat, levels ...CompressLevel) {
+		for _, level := range levels {
+			formats = append(formats, Compression{format, level})
+		}
+	}
+	add(FormatNone, LevelDefault)
+	add(FormatGzip, LevelFast, LevelDefault, LevelBest)
+	// lz4 has no separate default level, it's the same as fast
+	add(FormatLz4, LevelFast, LevelBest)
+	// lzma doesn't support setting a level
+	add(FormatLzma, LevelDefault)
+	add(FormatZstd, LevelFast, LevelDefault, LevelBest)
+	return
+}
+
+// Payload returns the uncompressed cpio archive, with all transforms applied
+func (archive *Archive) Payload() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := cpio.NewWriter(buf)
+	if err := archive.writeItems(writer); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("archive.Payload: error closing archive: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Bench compresses the payload with the given format and level, and then
+// decompresses it again to make sure that the result matches the payload.
+func Bench(payload []byte, format CompressFormat, level CompressLevel) (BenchResult, error) {
+	result := BenchResult{
+		Format: format,
+		Level:  level,
+	}
+
+	var compressed bytes.Buffer
+	compressed.Grow(len(payload))
+	var err error
+	result.CompressTime, result.CompressMemory, err = measure(func() error {
+		compressor, err := newCompressor(&compressed, format, level)
+		if err != nil {
+			return err
+		}
+		if _, err := compressor.Write(payload); err != nil {
+			return err
+		}
+		return compressor.Close()
+	})
+	if err != nil {
+		return result, fmt.Errorf("unable to compress with %s:%s: %w", format, level, err)
+	}
+	result.Size = int64(compressed.Len())
+
+	// decompression in the kernel is single-threaded
+	prevProcs := runtime.GOMAXPROCS(1)
+	defer runtime.GOMAXPROCS(prevProcs)
+
+	var decompressed bytes.Buffer
+	decompressed.Grow(len(payload))
+	result.DecompressTime, result.DecompressMemory, err = measure(func() error {
+		decompressor, err := newDecompressor(bytes.NewReader(compressed.Bytes()), format)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		_, err = io.Copy(&decompressed, decompressor)
+		return err
+	})
+	if err != nil {
+		return result, fmt.Errorf("unable to decompress %s:%s: %w", format, level, err)
+	}
+	if !bytes.Equal(decompressed.Bytes(), payload) {
+		return result, fmt.Errorf("decompressed %s:%s archive doesn't match the original", format, level)
+	}
+
+	return result, nil
+}
+
+// measure runs f, and returns how long it took and the peak heap memory that
+// was in use while it ran. The memory use is sampled, so very short peaks
+// might be missed.
+func measure(f func() error) (elapsed time.Duration, peak uint64, err error) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	heapInUse := func() uint64 {
+		metrics.Read(sample)
+		if sample[0].Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+		return sample[0].Value.Uint64()
+	}
+
+	runtime.GC()
+	base := heapInUse()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			if cur := heapInUse(); cur > base && cur-base > peak {
+				peak = cur - base
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	start := time.Now()
+	err = f()
+	elapsed = time.Since(start)
+
+	close(done)
+	wg.Wait()
+
+	return elapsed, peak, err
+}
+
+// newDecompressor returns a ReadCloser that decompresses everything read from
+// r with the given format, the counterpart of newCompressor. Close doesn't
+// close r.
+func newDecompressor(r io.Reader, format CompressFormat) (io.ReadCloser, error) {
+	switch format {
+	case FormatGzip:
+		return gzip.NewReader(r)
+	case FormatLzma:
+		reader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(reader), nil
+	case FormatLz4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	case FormatNone:
+		return io.NopCloser(r), nil
+	case FormatZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		// newCompressor uses gzip for unknown formats
+		return gzip.NewReader(r)
+	}
+}
+
+// WriteBenchReport writes a table with the given results to w. The size of
+// the uncompressed payload is used to show the compression ratio.
+func WriteBenchReport(w io.Writer, payloadSize int64, results []BenchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Format\tSize\tRatio\tCompress\tMemory\tDecompress\tMemory\t\n")
+	for _, r := range results {
+		ratio := 0.0
+		if payloadSize > 0 {
+			ratio = float64(r.Size) / float64(payloadSize) * 100
+		}
+		fmt.Fprintf(tw, "%s:%s\t%s\t%.1f%%\t%s\t%s\t%s\t%s\t\n",
+			r.Format, r.Level,
+			FormatSize(r.Size),
+			ratio,
+			r.CompressTime.Round(100*time.Microsecond),
+			FormatSize(int64(r.CompressMemory)),
+			r.DecompressTime.Round(100*time.Microsecond),
+			FormatSize(int64(r.DecompressMemory)))
+	}
+	return tw.Flush()
+}
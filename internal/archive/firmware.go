@@ -0,0 +1,72 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
+)
+
+// DecompressFirmware is a Transform that decompresses firmware files that are
+// compressed in a format the kernel can't load. The decompressed firmware is
+// stored under the original file name, e.g. "foo.bin.zst" becomes "foo.bin".
+type DecompressFirmware struct {
+	supported map[string]bool
+}
+
+// NewDecompressFirmware returns a new DecompressFirmware transform. supported
+// is the list of compression extensions (e.g. misc.ExtZstd) that the kernel
+// is able to load firmware in.
+func NewDecompressFirmware(supported []string) *DecompressFirmware {
+	d := &DecompressFirmware{
+		supported: make(map[string]bool),
+	}
+	for _, ext := range supported {
+		d.supported[ext] = true
+	}
+	return d
+}
+
+// FirmwareSupport returns the list of compression extensions that a kernel
+// with the given config can load firmware in.
+func FirmwareSupport(config osutil.KernelConfig) (supported []string) {
+	if !config.BuiltIn("CONFIG_FW_LOADER_COMPRESS") {
+		return
+	}
+	if config.BuiltIn("CONFIG_FW_LOADER_COMPRESS_XZ") {
+		supported = append(supported, misc.ExtXz)
+	}
+	if config.BuiltIn("CONFIG_FW_LOADER_COMPRESS_ZSTD") {
+		supported = append(supported, misc.ExtZstd)
+	}
+	if len(supported) == 0 {
+		// Kernels before 5.19 only supported xz, and didn't have an option
+		// for each format
+		supported = append(supported, misc.ExtXz)
+	}
+	return
+}
+
+func (d *DecompressFirmware) Rename(f filelist.File) string {
+	ext := misc.CompressionExt(f.Dest)
+	if !isFirmware(f.Dest) || ext == "" || d.supported[ext] {
+		return f.Dest
+	}
+	return strings.TrimSuffix(f.Dest, ext)
+}
+
+func (d *DecompressFirmware) Match(f filelist.File) bool {
+	return isFirmware(f.Dest) && misc.CompressionExt(f.Source) != misc.CompressionExt(f.Dest)
+}
+
+func (d *DecompressFirmware) Apply(f filelist.File, data []byte) ([]byte, error) {
+	return misc.Decompress(misc.CompressionExt(f.Source), data)
+}
+
+func isFirmware(path string) bool {
+	return strings.Contains(path, "/lib/firmware/")
+}
@@ -0,0 +1,32 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"fmt"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
+)
+
+// kernelDecompressOptions are the kernel config options needed to extract an
+// initramfs in each compression format. FormatLzma is written in the xz
+// container format, so it needs the xz decompressor.
+var kernelDecompressOptions = map[CompressFormat]string{
+	FormatGzip: "CONFIG_RD_GZIP",
+	FormatLzma: "CONFIG_RD_XZ",
+	FormatLz4:  "CONFIG_RD_LZ4",
+	FormatZstd: "CONFIG_RD_ZSTD",
+}
+
+// KernelSupport returns an error if a kernel with the given config can't
+// extract an initramfs compressed with the given format.
+func KernelSupport(format CompressFormat, config osutil.KernelConfig) error {
+	if !config.BuiltIn("CONFIG_BLK_DEV_INITRD") {
+		return fmt.Errorf("kernel doesn't support an initramfs, CONFIG_BLK_DEV_INITRD is not set")
+	}
+	if option, found := kernelDecompressOptions[format]; found && !config.BuiltIn(option) {
+		return fmt.Errorf("kernel can't extract an initramfs compressed with %s, %s is not set", format, option)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cavaliergopher/cpio"
+)
+
+type OutputFormat string
+
+const (
+	// newc cpio archive, optionally compressed
+	OutputCpio OutputFormat = "cpio"
+	// tar archive, optionally compressed
+	OutputTar OutputFormat = "tar"
+	// plain directory tree, uncompressed
+	OutputDir OutputFormat = "dir"
+)
+
+// ParseOutputFormat returns the OutputFormat for the given string, or an error
+// if the format is not supported.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	format := OutputFormat(strings.ToLower(s))
+	switch format {
+	case OutputCpio, OutputTar, OutputDir:
+		return format, nil
+	}
+	return format, fmt.Errorf("unsupported output format: %q", s)
+}
+
+// OutputWriter is implemented by each supported output format. Items are
+// described with a cpio header, and follow the same rules as cpio.Writer:
+// WriteHeader is called for every item, followed by calls to Write with the
+// contents for regular files, or the link target for symlinks.
+type OutputWriter interface {
+	WriteHeader(hdr *cpio.Header) error
+	Write(b []byte) (int, error)
+	Close() error
+}
+
+// tarWriter is an OutputWriter for tar archives
+type tarWriter struct {
+	tw        *tar.Writer
+	isSymlink bool
+}
+
+func newTarWriter(w io.Writer) *tarWriter {
+	return &tarWriter{
+		tw: tar.NewWriter(w),
+	}
+}
+
+func (t *tarWriter) WriteHeader(hdr *cpio.Header) error {
+	modTime := hdr.ModTime
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0)
+	}
+	th := &tar.Header{
+		Name:    hdr.Name,
+		Mode:    int64(hdr.Mode.Perm()),
+		Uid:     hdr.Uid,
+		Gid:     hdr.Guid,
+		ModTime: modTime,
+		Format:  tar.FormatPAX,
+	}
+
+	t.isSymlink = false
+	switch hdr.Mode &^ cpio.ModePerm {
+	case cpio.TypeDir:
+		th.Typeflag = tar.TypeDir
+	case cpio.TypeSymlink:
+		th.Typeflag = tar.TypeSymlink
+		th.Linkname = hdr.Linkname
+		t.isSymlink = true
+	case cpio.TypeReg:
+		th.Typeflag = tar.TypeReg
+		th.Size = hdr.Size
+	default:
+		return fmt.Errorf("unsupported file type for %q: %o", hdr.Name, hdr.Mode)
+	}
+
+	return t.tw.WriteHeader(th)
+}
+
+func (t *tarWriter) Write(b []byte) (int, error) {
+	if t.isSymlink {
+		// link target is already in the header
+		return len(b), nil
+	}
+	return t.tw.Write(b)
+}
+
+func (t *tarWriter) Close() error {
+	return t.tw.Close()
+}
+
+// dirWriter is an OutputWriter that creates a directory tree
+type dirWriter struct {
+	root string
+	fd   *os.File
+}
+
+func newDirWriter(root string) (*dirWriter, error) {
+	if _, err := os.Lstat(root); err == nil {
+		return nil, fmt.Errorf("output directory already exists: %q", root)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &dirWriter{
+		root: root,
+	}, nil
+}
+
+func (d *dirWriter) WriteHeader(hdr *cpio.Header) error {
+	if err := d.closeFile(); err != nil {
+		return err
+	}
+
+	name := filepath.Clean(hdr.Name)
+	if name == ".." || strings.HasPrefix(name, "../") || filepath.IsAbs(name) {
+		return fmt.Errorf("invalid path in archive: %q", hdr.Name)
+	}
+	path := filepath.Join(d.root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	switch hdr.Mode &^ cpio.ModePerm {
+	case cpio.TypeDir:
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		return os.Chmod(path, os.FileMode(hdr.Mode.Perm()))
+	case cpio.TypeSymlink:
+		return os.Symlink(hdr.Linkname, path)
+	case cpio.TypeReg:
+		fd, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode.Perm()))
+		if err != nil {
+			return err
+		}
+		d.fd = fd
+		return nil
+	}
+
+	return fmt.Errorf("unsupported file type for %q: %o", hdr.Name, hdr.Mode)
+}
+
+func (d *dirWriter) Write(b []byte) (int, error) {
+	if d.fd == nil {
+		// symlink target, which was already used when creating it
+		return len(b), nil
+	}
+	return d.fd.Write(b)
+}
+
+func (d *dirWriter) Close() error {
+	return d.closeFile()
+}
+
+func (d *dirWriter) closeFile() error {
+	if d.fd == nil {
+		return nil
+	}
+	err := d.fd.Close()
+	d.fd = nil
+	return err
+}
@@ -0,0 +1,185 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ItemSize is the size of a single file or symlink in the archive
+type ItemSize struct {
+	// Path in the archive
+	Name string
+	// The list file or directory that the item came from
+	Origin string
+	// Uncompressed size, after any transforms are applied
+	Size int64
+	// Estimated size when compressed, see Archive.Sizes
+	Compressed int64
+}
+
+// counts bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.n += int64(len(b))
+	return len(b), nil
+}
+
+// Sizes returns the size of every regular file and symlink in the archive.
+// The compressed size of each item is estimated by compressing it on its own
+// with the archive's compression format and level, so it doesn't account for
+// redundancy between files or archive headers.
+func (archive *Archive) Sizes() ([]ItemSize, error) {
+	var sizes []ItemSize
+	for item := range archive.items.IterItems() {
+		if item.header.Mode.IsDir() {
+			continue
+		}
+
+		size := ItemSize{
+			Name:   "/" + item.header.Name,
+			Origin: item.origin,
+		}
+
+		var data []byte
+		if item.header.Linkname != "" {
+			data = []byte(item.header.Linkname)
+		} else {
+			var err error
+			if data, err = archive.transform(item); err != nil {
+				return nil, fmt.Errorf("unable to transform %q: %w", item.sourcePath, err)
+			}
+			if data == nil {
+				if data, err = os.ReadFile(item.sourcePath); err != nil {
+					return nil, err
+				}
+			}
+		}
+		size.Size = int64(len(data))
+
+		counter := &countingWriter{}
+		compressor, err := newCompressor(counter, archive.compress_format, archive.compress_level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := compressor.Write(data); err != nil {
+			return nil, err
+		}
+		if err := compressor.Close(); err != nil {
+			return nil, err
+		}
+		size.Compressed = counter.n
+
+		sizes = append(sizes, size)
+	}
+
+	return sizes, nil
+}
+
+// WriteSizeReport writes a summary of the given sizes to w, grouped by
+// top-level directory and by origin, followed by the n largest items.
+func WriteSizeReport(w io.Writer, sizes []ItemSize, n int) error {
+	type group struct {
+		name       string
+		size       int64
+		compressed int64
+		count      int
+	}
+	groupBy := func(key func(ItemSize) string) []group {
+		m := make(map[string]*group)
+		for _, s := range sizes {
+			k := key(s)
+			g, found := m[k]
+			if !found {
+				g = &group{name: k}
+				m[k] = g
+			}
+			g.size += s.Size
+			g.compressed += s.Compressed
+			g.count++
+		}
+		var groups []group
+		for _, g := range m {
+			groups = append(groups, *g)
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			if groups[i].size != groups[j].size {
+				return groups[i].size > groups[j].size
+			}
+			return groups[i].name < groups[j].name
+		})
+		return groups
+	}
+
+	var total, totalCompressed int64
+	for _, s := range sizes {
+		total += s.Size
+		totalCompressed += s.Compressed
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Size\tCompressed (est.)\tFiles\t\n")
+	fmt.Fprintf(tw, "%s\t%s\t%d\t  Total\n", FormatSize(total), FormatSize(totalCompressed), len(sizes))
+
+	fmt.Fprintf(tw, "\t\t\t\n")
+	fmt.Fprintf(tw, "\t\t\t  By top-level directory:\n")
+	for _, g := range groupBy(func(s ItemSize) string {
+		dir, _, _ := strings.Cut(strings.TrimPrefix(s.Name, "/"), "/")
+		return "/" + dir
+	}) {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t  %s\n", FormatSize(g.size), FormatSize(g.compressed), g.count, g.name)
+	}
+
+	fmt.Fprintf(tw, "\t\t\t\n")
+	fmt.Fprintf(tw, "\t\t\t  By list:\n")
+	for _, g := range groupBy(func(s ItemSize) string {
+		if s.Origin == "" {
+			return "(other)"
+		}
+		return s.Origin
+	}) {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t  %s\n", FormatSize(g.size), FormatSize(g.compressed), g.count, g.name)
+	}
+
+	largest := make([]ItemSize, len(sizes))
+	copy(largest, sizes)
+	sort.Slice(largest, func(i, j int) bool {
+		if largest[i].Size != largest[j].Size {
+			return largest[i].Size > largest[j].Size
+		}
+		return largest[i].Name < largest[j].Name
+	})
+	if n < len(largest) {
+		largest = largest[:n]
+	}
+	fmt.Fprintf(tw, "\t\t\t\n")
+	fmt.Fprintf(tw, "\t\t\t  Largest files:\n")
+	for _, s := range largest {
+		fmt.Fprintf(tw, "%s\t%s\t\t  %s\n", FormatSize(s.Size), FormatSize(s.Compressed), s.Name)
+	}
+
+	return tw.Flush()
+}
+
+// FormatSize returns the given size in bytes as a human-readable string
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,350 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+)
+
+// StripDebug is a Transform that removes non-allocated debug and symbol table
+// sections from ELF executables and shared libraries. Kernel modules and other
+// relocatable objects are never stripped, since they need their symbol tables.
+type StripDebug struct {
+	// Strip files that don't have a per-file StripMode set
+	Default bool
+}
+
+// NewStripDebug returns a new StripDebug transform. If enabled is false, then
+// only files with the filelist.StripAlways attribute are stripped.
+func NewStripDebug(enabled bool) *StripDebug {
+	return &StripDebug{
+		Default: enabled,
+	}
+}
+
+func (s *StripDebug) Match(f filelist.File) bool {
+	switch f.Attrs.Strip {
+	case filelist.StripNever:
+		return false
+	case filelist.StripDefault:
+		if !s.Default {
+			return false
+		}
+	}
+
+	fd, err := elf.Open(f.Source)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+
+	return fd.Type == elf.ET_EXEC || fd.Type == elf.ET_DYN
+}
+
+func (s *StripDebug) Apply(f filelist.File, data []byte) ([]byte, error) {
+	out, err := stripELF(data)
+	if err != nil {
+		// not fatal, the file is still usable as-is
+		log.Printf("-- Unable to strip %q, adding it unmodified: %s", f.Source, err)
+		return data, nil
+	}
+
+	return out, nil
+}
+
+// section header, with fields common to both 32 and 64-bit ELF files
+type elfSection struct {
+	name      string
+	nameOff   uint32
+	typ       elf.SectionType
+	flags     elf.SectionFlag
+	addr      uint64
+	offset    uint64
+	size      uint64
+	link      uint32
+	info      uint32
+	addralign uint64
+	entsize   uint64
+}
+
+// stripELF returns a copy of the given ELF file, without any non-allocated
+// debug info, symbol tables, or sections that only apply to them. Everything
+// loaded at runtime (i.e. the contents of all program segments) is kept at the
+// same offset in the file.
+func stripELF(data []byte) ([]byte, error) {
+	ef, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+
+	is64 := ef.Class == elf.ELFCLASS64
+	bo := ef.ByteOrder
+
+	var phoff, shoff uint64
+	var phentsize, phnum, shentsize, shnum, shstrndx uint16
+	if is64 {
+		phoff = bo.Uint64(data[32:])
+		shoff = bo.Uint64(data[40:])
+		phentsize = bo.Uint16(data[54:])
+		phnum = bo.Uint16(data[56:])
+		shentsize = bo.Uint16(data[58:])
+		shnum = bo.Uint16(data[60:])
+		shstrndx = bo.Uint16(data[62:])
+	} else {
+		phoff = uint64(bo.Uint32(data[28:]))
+		shoff = uint64(bo.Uint32(data[32:]))
+		phentsize = bo.Uint16(data[42:])
+		phnum = bo.Uint16(data[44:])
+		shentsize = bo.Uint16(data[46:])
+		shnum = bo.Uint16(data[48:])
+		shstrndx = bo.Uint16(data[50:])
+	}
+
+	if shnum == 0 || shstrndx == uint16(elf.SHN_UNDEF) || shstrndx >= uint16(elf.SHN_LORESERVE) {
+		// No sections, or extended section numbering, which isn't worth
+		// supporting here.
+		return nil, fmt.Errorf("unsupported section header layout")
+	}
+	if int(shnum) != len(ef.Sections) {
+		return nil, fmt.Errorf("unexpected number of sections, got %d, expected %d", len(ef.Sections), shnum)
+	}
+	if shoff+uint64(shnum)*uint64(shentsize) > uint64(len(data)) {
+		return nil, fmt.Errorf("section headers are out of bounds")
+	}
+
+	sections := make([]elfSection, shnum)
+	for i := range sections {
+		sh := data[shoff+uint64(i)*uint64(shentsize):]
+		s := &sections[i]
+		s.name = ef.Sections[i].Name
+		s.nameOff = bo.Uint32(sh[0:])
+		s.typ = elf.SectionType(bo.Uint32(sh[4:]))
+		if is64 {
+			s.flags = elf.SectionFlag(bo.Uint64(sh[8:]))
+			s.addr = bo.Uint64(sh[16:])
+			s.offset = bo.Uint64(sh[24:])
+			s.size = bo.Uint64(sh[32:])
+			s.link = bo.Uint32(sh[40:])
+			s.info = bo.Uint32(sh[44:])
+			s.addralign = bo.Uint64(sh[48:])
+			s.entsize = bo.Uint64(sh[56:])
+		} else {
+			s.flags = elf.SectionFlag(bo.Uint32(sh[8:]))
+			s.addr = uint64(bo.Uint32(sh[12:]))
+			s.offset = uint64(bo.Uint32(sh[16:]))
+			s.size = uint64(bo.Uint32(sh[20:]))
+			s.link = bo.Uint32(sh[24:])
+			s.info = bo.Uint32(sh[28:])
+			s.addralign = uint64(bo.Uint32(sh[32:]))
+			s.entsize = uint64(bo.Uint32(sh[36:]))
+		}
+		if s.typ != elf.SHT_NOBITS && s.offset+s.size > uint64(len(data)) {
+			return nil, fmt.Errorf("section %q is out of bounds", s.name)
+		}
+	}
+
+	remove := make([]bool, shnum)
+	for i, s := range sections {
+		if i == 0 || i == int(shstrndx) || s.flags&elf.SHF_ALLOC != 0 {
+			continue
+		}
+		if strings.HasPrefix(s.name, ".debug") || strings.HasPrefix(s.name, ".zdebug") || s.typ == elf.SHT_SYMTAB {
+			remove[i] = true
+		}
+	}
+	// Sections that only exist to support removed sections, e.g. the string
+	// table for .symtab or relocations for debug sections, are removed too.
+	for i, s := range sections {
+		if remove[i] || i == 0 || i == int(shstrndx) || s.flags&elf.SHF_ALLOC != 0 {
+			continue
+		}
+		switch s.typ {
+		case elf.SHT_REL, elf.SHT_RELA:
+			if int(s.info) < len(remove) && remove[s.info] {
+				remove[i] = true
+			}
+		case elf.SHT_SYMTAB_SHNDX:
+			if int(s.link) < len(remove) && remove[s.link] {
+				remove[i] = true
+			}
+		}
+	}
+	for i, s := range sections {
+		if s.typ != elf.SHT_SYMTAB || !remove[i] || int(s.link) >= len(sections) {
+			continue
+		}
+		strtab := int(s.link)
+		if strtab == int(shstrndx) || sections[strtab].flags&elf.SHF_ALLOC != 0 {
+			continue
+		}
+		// only remove the string table if nothing else is using it
+		used := false
+		for j, o := range sections {
+			if !remove[j] && j != strtab && int(o.link) == strtab {
+				used = true
+				break
+			}
+		}
+		if !used {
+			remove[strtab] = true
+		}
+	}
+
+	removed := false
+	newIndex := make([]uint32, shnum)
+	var kept []int
+	for i := range sections {
+		if remove[i] {
+			removed = true
+			continue
+		}
+		newIndex[i] = uint32(len(kept))
+		kept = append(kept, i)
+	}
+	if !removed {
+		return data, nil
+	}
+
+	// Everything up to the end of the last program segment or allocated
+	// section is copied as-is
+	end := phoff + uint64(phnum)*uint64(phentsize)
+	for i := 0; i < int(phnum); i++ {
+		ph := data[phoff+uint64(i)*uint64(phentsize):]
+		var off, filesz uint64
+		if is64 {
+			off = bo.Uint64(ph[8:])
+			filesz = bo.Uint64(ph[32:])
+		} else {
+			off = uint64(bo.Uint32(ph[4:]))
+			filesz = uint64(bo.Uint32(ph[16:]))
+		}
+		end = max(end, off+filesz)
+	}
+	for _, i := range kept {
+		s := sections[i]
+		if s.flags&elf.SHF_ALLOC != 0 && s.typ != elf.SHT_NOBITS {
+			end = max(end, s.offset+s.size)
+		}
+	}
+	if end > uint64(len(data)) {
+		return nil, fmt.Errorf("program segments are out of bounds")
+	}
+
+	out := make([]byte, end, len(data))
+	copy(out, data[:end])
+
+	// Non-allocated sections that are kept are moved to the end
+	for _, i := range kept {
+		s := &sections[i]
+		if i == 0 || s.flags&elf.SHF_ALLOC != 0 {
+			continue
+		}
+		if s.typ == elf.SHT_NOBITS {
+			s.offset = uint64(len(out))
+			continue
+		}
+		if s.offset+s.size <= end {
+			continue
+		}
+		out = alignBytes(out, s.addralign)
+		contents := data[s.offset : s.offset+s.size]
+		s.offset = uint64(len(out))
+		out = append(out, contents...)
+	}
+
+	// Dynamic symbols reference sections by index
+	for _, i := range kept {
+		s := sections[i]
+		if s.typ != elf.SHT_DYNSYM || s.entsize == 0 {
+			continue
+		}
+		shndxOff := uint64(14)
+		if is64 {
+			shndxOff = 6
+		}
+		for sym := s.offset; sym+s.entsize <= s.offset+s.size; sym += s.entsize {
+			idx := bo.Uint16(out[sym+shndxOff:])
+			if idx == uint16(elf.SHN_UNDEF) || idx >= uint16(elf.SHN_LORESERVE) || int(idx) >= len(newIndex) {
+				continue
+			}
+			bo.PutUint16(out[sym+shndxOff:], uint16(newIndex[idx]))
+		}
+	}
+
+	if is64 {
+		out = alignBytes(out, 8)
+	} else {
+		out = alignBytes(out, 4)
+	}
+	newShoff := uint64(len(out))
+	for _, i := range kept {
+		s := sections[i]
+		if int(s.link) < len(newIndex) {
+			s.link = newIndex[s.link]
+		} else {
+			s.link = 0
+		}
+		if (s.typ == elf.SHT_REL || s.typ == elf.SHT_RELA || s.flags&elf.SHF_INFO_LINK != 0) && int(s.info) < len(newIndex) {
+			s.info = newIndex[s.info]
+		}
+		out = appendSectionHeader(out, bo, is64, s, int(shentsize))
+	}
+
+	if is64 {
+		bo.PutUint64(out[40:], newShoff)
+		bo.PutUint16(out[60:], uint16(len(kept)))
+		bo.PutUint16(out[62:], uint16(newIndex[shstrndx]))
+	} else {
+		bo.PutUint32(out[32:], uint32(newShoff))
+		bo.PutUint16(out[48:], uint16(len(kept)))
+		bo.PutUint16(out[50:], uint16(newIndex[shstrndx]))
+	}
+
+	return out, nil
+}
+
+func appendSectionHeader(out []byte, bo binary.ByteOrder, is64 bool, s elfSection, size int) []byte {
+	sh := make([]byte, size)
+	bo.PutUint32(sh[0:], s.nameOff)
+	bo.PutUint32(sh[4:], uint32(s.typ))
+	if is64 {
+		bo.PutUint64(sh[8:], uint64(s.flags))
+		bo.PutUint64(sh[16:], s.addr)
+		bo.PutUint64(sh[24:], s.offset)
+		bo.PutUint64(sh[32:], s.size)
+		bo.PutUint32(sh[40:], s.link)
+		bo.PutUint32(sh[44:], s.info)
+		bo.PutUint64(sh[48:], s.addralign)
+		bo.PutUint64(sh[56:], s.entsize)
+	} else {
+		bo.PutUint32(sh[8:], uint32(s.flags))
+		bo.PutUint32(sh[12:], uint32(s.addr))
+		bo.PutUint32(sh[16:], uint32(s.offset))
+		bo.PutUint32(sh[20:], uint32(s.size))
+		bo.PutUint32(sh[24:], s.link)
+		bo.PutUint32(sh[28:], s.info)
+		bo.PutUint32(sh[32:], uint32(s.addralign))
+		bo.PutUint32(sh[36:], uint32(s.entsize))
+	}
+	return append(out, sh...)
+}
+
+// pads the given slice with zeroes, so that its length is a multiple of align
+func alignBytes(b []byte, align uint64) []byte {
+	if align <= 1 {
+		return b
+	}
+	for uint64(len(b))%align != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,22 @@
+// Source for the "hello" test binary, which has debug info and a symbol
+// table for the strip tests. It doesn't use libc, so that it runs anywhere
+// and stays small. Built with:
+//
+//	gcc -g -Os -static -nostdlib -fno-asynchronous-unwind-tables -o hello hello.c
+
+static const char msg[] = "hello\n";
+
+static long syscall3(long n, long a, long b, long c)
+{
+	long ret;
+	__asm__ volatile ("syscall" : "=a"(ret) : "a"(n), "D"(a), "S"(b), "d"(c) : "rcx", "r11", "memory");
+	return ret;
+}
+
+void _start(void)
+{
+	syscall3(1, 1, (long)msg, sizeof(msg) - 1); // write
+	syscall3(60, 0, 0, 0);                      // exit
+	for (;;)
+		;
+}
@@ -0,0 +1,243 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package archive
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/cavaliergopher/cpio"
+	"golang.org/x/sys/unix"
+)
+
+// manifestEntry describes an item as it was written to the archive
+type manifestEntry struct {
+	// file type bits, e.g. cpio.TypeReg
+	mode cpio.FileMode
+	// size of the file contents, or the link target for symlinks
+	size int64
+	// sha256 of the file contents, or the link target for symlinks
+	sum [sha256.Size]byte
+}
+
+// Verify reads back the archive that was written to path by the last call to
+// Write, and checks that it contains exactly the items that were written, with
+// the expected contents. The archive is decompressed and parsed in full, so
+// truncated or corrupted archives are detected.
+func (archive *Archive) Verify(path string) error {
+	if archive.manifest == nil {
+		return fmt.Errorf("archive.Verify: archive hasn't been written")
+	}
+
+	var err error
+	if archive.output_format == OutputDir {
+		err = archive.verifyDir(path)
+	} else {
+		err = archive.verifyFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("archive.Verify: %q: %w", path, err)
+	}
+
+	return nil
+}
+
+func (archive *Archive) verifyFile(path string) (err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		e := fd.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	// Try to make sure the archive is read back from the disk rather than
+	// from the page cache. This is best-effort, since not every filesystem
+	// supports it.
+	_ = unix.Fadvise(int(fd.Fd()), 0, 0, unix.FADV_DONTNEED)
+
+	decompressor, err := newDecompressor(fd, archive.compress_format)
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+
+	var next func() (string, manifestEntry, error)
+	switch archive.output_format {
+	case OutputTar:
+		next = tarEntries(tar.NewReader(decompressor))
+	default:
+		next = cpioEntries(cpio.NewReader(decompressor))
+	}
+
+	seen := make(map[string]bool)
+	for {
+		name, got, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if seen[name] {
+			return fmt.Errorf("%q appears more than once", name)
+		}
+		seen[name] = true
+		if err := archive.compareEntry(name, got); err != nil {
+			return err
+		}
+	}
+
+	// Anything after the end of the archive is padding, but it must still be
+	// read so that the decompressor checks the integrity of the whole stream
+	if _, err := io.Copy(io.Discard, decompressor); err != nil {
+		return err
+	}
+
+	return archive.checkMissing(seen)
+}
+
+func (archive *Archive) verifyDir(root string) error {
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		// the root is the output dir itself, which is only in the manifest
+		// if something added "/" to the archive, e.g. the merged /usr
+		// symlinks
+		if name == "." {
+			seen[name] = true
+			return nil
+		}
+
+		got := manifestEntry{}
+		hash := sha256.New()
+		switch {
+		case d.IsDir():
+			got.mode = cpio.TypeDir
+		case d.Type()&fs.ModeSymlink != 0:
+			got.mode = cpio.TypeSymlink
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			got.size = int64(len(target))
+			hash.Write([]byte(target))
+		case d.Type().IsRegular():
+			got.mode = cpio.TypeReg
+			fd, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			if got.size, err = io.Copy(hash, fd); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%q has an unexpected file type: %s", name, d.Type())
+		}
+		copy(got.sum[:], hash.Sum(nil))
+
+		seen[name] = true
+		return archive.compareEntry(name, got)
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.checkMissing(seen)
+}
+
+// cpioEntries returns a function that returns the next entry in the cpio
+// archive each time it's called, or io.EOF at the end of the archive.
+func cpioEntries(r *cpio.Reader) func() (string, manifestEntry, error) {
+	return func() (string, manifestEntry, error) {
+		hdr, err := r.Next()
+		if err != nil {
+			return "", manifestEntry{}, err
+		}
+		entry, err := readEntry(hdr.Mode&^cpio.ModePerm, hdr.Linkname, r)
+		return hdr.Name, entry, err
+	}
+}
+
+// tarEntries is like cpioEntries, for tar archives
+func tarEntries(r *tar.Reader) func() (string, manifestEntry, error) {
+	return func() (string, manifestEntry, error) {
+		hdr, err := r.Next()
+		if err != nil {
+			return "", manifestEntry{}, err
+		}
+		var mode cpio.FileMode
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			mode = cpio.TypeDir
+		case tar.TypeSymlink:
+			mode = cpio.TypeSymlink
+		case tar.TypeReg:
+			mode = cpio.TypeReg
+		default:
+			return "", manifestEntry{}, fmt.Errorf("%q has an unexpected file type: %c", hdr.Name, hdr.Typeflag)
+		}
+		entry, err := readEntry(mode, hdr.Linkname, r)
+		return hdr.Name, entry, err
+	}
+}
+
+// readEntry returns a manifestEntry for an item read from an archive, using
+// the contents in r for regular files.
+func readEntry(mode cpio.FileMode, linkname string, r io.Reader) (manifestEntry, error) {
+	entry := manifestEntry{mode: mode}
+	hash := sha256.New()
+	switch mode {
+	case cpio.TypeSymlink:
+		entry.size = int64(len(linkname))
+		hash.Write([]byte(linkname))
+	case cpio.TypeReg:
+		var err error
+		if entry.size, err = io.Copy(hash, r); err != nil {
+			return entry, err
+		}
+	}
+	copy(entry.sum[:], hash.Sum(nil))
+	return entry, nil
+}
+
+func (archive *Archive) compareEntry(name string, got manifestEntry) error {
+	expected, found := archive.manifest[name]
+	switch {
+	case !found:
+		return fmt.Errorf("unexpected item in archive: %q", name)
+	case got.mode != expected.mode:
+		return fmt.Errorf("%q has type %o, expected %o", name, got.mode, expected.mode)
+	case got.size != expected.size:
+		return fmt.Errorf("%q has size %d, expected %d", name, got.size, expected.size)
+	case got.sum != expected.sum:
+		return fmt.Errorf("%q has unexpected contents", name)
+	}
+	return nil
+}
+
+func (archive *Archive) checkMissing(seen map[string]bool) error {
+	for name := range archive.manifest {
+		if !seen[name] {
+			return fmt.Errorf("%q is missing from archive", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package filelist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+)
+
+// conditionRegex matches a condition at the start of a line, e.g.
+// "[deviceinfo_arch=aarch64]" or "[!deviceinfo_gpu_accelerated]"
+var conditionRegex = regexp.MustCompile(`^\[(!?)(deviceinfo_[A-Za-z0-9_]+)(?:(!?=)([^\]]*))?\]`)
+
+// FilterConditions returns the lines read from r, with any conditions at the
+// start of the lines evaluated against the given deviceinfo:
+//
+//   - "[deviceinfo_foo]" holds if deviceinfo_foo is set to anything other than
+//     an empty string or a false boolean, e.g. "false"
+//   - "[deviceinfo_foo=bar]" holds if deviceinfo_foo is set to "bar"
+//   - "[deviceinfo_foo!=bar]" holds if deviceinfo_foo isn't set to "bar"
+//   - "[!...]" negates the condition
+//
+// A line can start with more than one condition, and is kept only if all of
+// them hold. The conditions are removed from lines that are kept, and lines
+// that aren't kept are replaced by empty lines so that line numbers don't
+// change.
+func FilterConditions(r io.Reader, devinfo deviceinfo.DeviceInfo) (io.Reader, error) {
+	var out strings.Builder
+
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line, keep, err := checkConditions(strings.TrimSpace(s.Text()), devinfo)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if keep {
+			out.WriteString(line)
+		}
+		out.WriteString("\n")
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return strings.NewReader(out.String()), nil
+}
+
+// checkConditions returns the given line without the conditions at its start,
+// and whether all of them hold.
+func checkConditions(line string, devinfo deviceinfo.DeviceInfo) (string, bool, error) {
+	keep := true
+	for strings.HasPrefix(line, "[deviceinfo_") || strings.HasPrefix(line, "[!deviceinfo_") {
+		m := conditionRegex.FindStringSubmatch(line)
+		if m == nil {
+			return "", false, fmt.Errorf("invalid condition in line: %q", line)
+		}
+		negate, name, op, want := m[1] == "!", m[2], m[3], m[4]
+
+		value, _ := devinfo.Value(name)
+		var holds bool
+		switch op {
+		case "=":
+			holds = value == want
+		case "!=":
+			holds = value != want
+		default:
+			b, err := strconv.ParseBool(value)
+			holds = value != "" && (err != nil || b)
+		}
+		if negate {
+			holds = !holds
+		}
+		keep = keep && holds
+
+		line = strings.TrimSpace(line[len(m[0]):])
+	}
+
+	return line, keep, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package filelist
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+)
+
+func TestFilterConditions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deviceinfo")
+	contents := `deviceinfo_format_version="0"
+deviceinfo_arch="aarch64"
+deviceinfo_gpu_accelerated="true"
+deviceinfo_keyboard="false"
+deviceinfo_chassis="handset"
+`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var devinfo deviceinfo.DeviceInfo
+	if err := devinfo.ReadDeviceinfo(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		in            string
+		expected      string
+		expectedError bool
+	}{
+		{"/usr/bin/foo", "/usr/bin/foo", false},
+		{"[deviceinfo_arch=aarch64] /usr/bin/foo", "/usr/bin/foo", false},
+		{"[deviceinfo_arch=armv7]/usr/bin/foo", "", false},
+		{"[deviceinfo_arch!=armv7]/usr/bin/foo", "/usr/bin/foo", false},
+		{"[!deviceinfo_arch=armv7]/usr/bin/foo", "/usr/bin/foo", false},
+		{"[deviceinfo_gpu_accelerated]/usr/bin/foo", "/usr/bin/foo", false},
+		{"[deviceinfo_keyboard]/usr/bin/foo", "", false},
+		{"[!deviceinfo_keyboard]/usr/bin/foo", "/usr/bin/foo", false},
+		{"[deviceinfo_chassis]/usr/bin/foo", "/usr/bin/foo", false},
+		{"[deviceinfo_not_set]/usr/bin/foo", "", false},
+		{"[deviceinfo_not_set=]/usr/bin/foo", "/usr/bin/foo", false},
+		{"[deviceinfo_arch=aarch64][deviceinfo_chassis=handset]snd-soc-*", "snd-soc-*", false},
+		{"[deviceinfo_arch=aarch64][deviceinfo_chassis=tablet]snd-soc-*", "", false},
+		{"[a-z]*-codec", "[a-z]*-codec", false},
+		{"[deviceinfo_arch=aarch64/usr/bin/foo", "", true},
+		{"[deviceinfo_arch-foo]/usr/bin/foo", "", true},
+	}
+	for _, table := range tables {
+		r, err := FilterConditions(strings.NewReader("# comment\n"+table.in+"\n"), devinfo)
+		if (err != nil) != table.expectedError {
+			t.Errorf("%q: unexpected error value: %v", table.in, err)
+			continue
+		}
+		if err != nil {
+			if !strings.HasPrefix(err.Error(), "line 2: ") {
+				t.Errorf("%q: expected error with line number, got: %v", table.in, err)
+			}
+			continue
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// lines are kept, so that line numbers don't change
+		if expected := "# comment\n" + table.expected + "\n"; string(out) != expected {
+			t.Errorf("%q: expected: %q, got: %q", table.in, expected, out)
+		}
+	}
+}
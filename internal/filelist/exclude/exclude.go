@@ -0,0 +1,165 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package exclude
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
+)
+
+// Exclude removes files from the list of another FileLister, using the glob
+// patterns in the exclude lists in the given dirs.
+type Exclude struct {
+	lister filelist.FileLister
+	dirs   []string
+	files  *filelist.FileList
+}
+
+// rule is a single pattern from an exclude list
+type rule struct {
+	pattern string
+	// the exclude list and line number that the pattern is from
+	origin string
+}
+
+// New returns a new Exclude that lists the files from the given FileLister,
+// minus the ones that match a pattern in the exclude lists in the given dirs.
+func New(lister filelist.FileLister, dirs ...string) *Exclude {
+	return &Exclude{
+		lister: lister,
+		dirs:   dirs,
+	}
+}
+
+func (e *Exclude) List() (*filelist.FileList, error) {
+	if e.files != nil {
+		return e.files, nil
+	}
+
+	list, err := e.lister.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []rule
+	for _, dir := range e.dirs {
+		dirRules, err := readRules(dir)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, dirRules...)
+	}
+
+	e.files = apply(list, rules)
+	return e.files, nil
+}
+
+func readRules(dir string) (rules []rule, err error) {
+	log.Printf("- Searching for exclude lists from %s", dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Println("-- Unable to find dir, skipping...")
+		return nil, nil
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("exclude: unable to open exclude list: %w", err)
+		}
+		defer f.Close()
+		log.Printf("-- Excluding files from: %s\n", path)
+
+		fileRules, err := slurpRules(f, path)
+		if err != nil {
+			return nil, fmt.Errorf("exclude: unable to process exclude list %q: %w", path, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	return rules, nil
+}
+
+func slurpRules(fd io.Reader, path string) (rules []rule, err error) {
+	s := bufio.NewScanner(fd)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !filepath.IsAbs(line) {
+			return nil, fmt.Errorf("line %d: pattern must be an absolute path: %q", lineNum, line)
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q: %w", lineNum, line, err)
+		}
+		if osutil.HasMergedUsr() {
+			line = osutil.MergeUsr(line)
+		}
+		rules = append(rules, rule{
+			pattern: filepath.Clean(line),
+			origin:  fmt.Sprintf("%s:%d", path, lineNum),
+		})
+	}
+	return rules, s.Err()
+}
+
+// match returns true if the pattern matches the given path, or one of the
+// directories it is in.
+func (r rule) match(path string) bool {
+	if osutil.HasMergedUsr() {
+		path = osutil.MergeUsr(path)
+	}
+	for p := filepath.Clean(path); p != "/" && p != "."; p = filepath.Dir(p) {
+		if found, _ := filepath.Match(r.pattern, p); found {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns a copy of the given list without the files whose source or
+// destination path matches one of the given rules. Every removed file is
+// logged, along with the rule that removed it.
+func apply(list *filelist.FileList, rules []rule) *filelist.FileList {
+	files := filelist.NewFileList()
+	var excluded []string
+	for f := range list.IterItems() {
+		if r, found := matchRule(f, rules); found {
+			name := f.Source
+			if f.Dest != f.Source {
+				name += ":" + f.Dest
+			}
+			excluded = append(excluded, fmt.Sprintf("-- Excluding %q, matches %q in %s", name, r.pattern, r.origin))
+			continue
+		}
+		files.AddFile(f)
+	}
+
+	sort.Strings(excluded)
+	for _, msg := range excluded {
+		log.Println(msg)
+	}
+
+	return files
+}
+
+func matchRule(f filelist.File, rules []rule) (rule, bool) {
+	for _, r := range rules {
+		if r.match(f.Source) || r.match(f.Dest) {
+			return r, true
+		}
+	}
+	return rule{}, false
+}
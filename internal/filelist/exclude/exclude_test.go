@@ -0,0 +1,89 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package exclude
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+)
+
+func TestSlurpRules(t *testing.T) {
+	tables := []struct {
+		in            string
+		expected      []string
+		expectedError bool
+	}{
+		{"", nil, false},
+		{"# comment\n\n/usr/share/foo/docs\n", []string{"/usr/share/foo/docs"}, false},
+		{"/usr/share/foo/*.txt\n  /opt/bar/  \n", []string{"/usr/share/foo/*.txt", "/opt/bar"}, false},
+		{"usr/share/foo\n", nil, true},
+		{"/usr/share/[foo\n", nil, true},
+	}
+	for _, table := range tables {
+		rules, err := slurpRules(strings.NewReader(table.in), "test")
+		if (err != nil) != table.expectedError {
+			t.Errorf("%q: unexpected error value: %v", table.in, err)
+			continue
+		}
+		var patterns []string
+		for _, r := range rules {
+			patterns = append(patterns, r.pattern)
+		}
+		if err == nil && !reflect.DeepEqual(patterns, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.in, table.expected, patterns)
+		}
+	}
+}
+
+type testLister struct {
+	files []filelist.File
+}
+
+func (l *testLister) List() (*filelist.FileList, error) {
+	list := filelist.NewFileList()
+	for _, f := range l.files {
+		list.AddFile(f)
+	}
+	return list, nil
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	rules := "/usr/share/foo/docs\n/usr/share/foo/*.txt\n/firmware/vendor/b.bin\n"
+	if err := os.WriteFile(filepath.Join(dir, "test"), []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lister := &testLister{files: []filelist.File{
+		{Source: "/usr/share/foo/a.conf", Dest: "/usr/share/foo/a.conf"},
+		{Source: "/usr/share/foo/readme.txt", Dest: "/usr/share/foo/readme.txt"},
+		{Source: "/usr/share/foo/sub/notes.txt", Dest: "/usr/share/foo/sub/notes.txt"},
+		{Source: "/usr/share/foo/docs/index.html", Dest: "/usr/share/foo/docs/index.html"},
+		{Source: "/usr/share/foo/docs", Dest: "/usr/share/foo/docs"},
+		{Source: "/opt/vendor/a.bin", Dest: "/firmware/vendor/a.bin"},
+		{Source: "/opt/vendor/b.bin", Dest: "/firmware/vendor/b.bin"},
+	}}
+
+	list, err := New(lister, dir, filepath.Join(dir, "missing")).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for f := range list.IterItems() {
+		got[f.Source] = f.Dest
+	}
+	expected := map[string]string{
+		"/usr/share/foo/a.conf":        "/usr/share/foo/a.conf",
+		"/usr/share/foo/sub/notes.txt": "/usr/share/foo/sub/notes.txt",
+		"/opt/vendor/a.bin":            "/firmware/vendor/a.bin",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %q, got: %q", expected, got)
+	}
+}
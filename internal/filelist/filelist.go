@@ -1,47 +1,107 @@
 package filelist
 
-import "sync"
+import (
+	"os"
+	"sync"
+)
 
 type FileLister interface {
 	List() (*FileList, error)
 }
 
+// StripMode is used to override whether or not an ELF file is stripped of
+// debug info when it's added to an archive.
+type StripMode int
+
+const (
+	// Use the archive's setting
+	StripDefault StripMode = iota
+	// Always strip the file
+	StripAlways
+	// Never strip the file
+	StripNever
+)
+
+// Attributes are optional, per-file settings that are carried along with a
+// File into the archive.
+type Attributes struct {
+	Strip StripMode
+	// If HasMode is set, Mode overrides the permission bits of the file
+	Mode    os.FileMode
+	HasMode bool
+	// If HasOwner is set, Uid and Gid override the owner of the file, which
+	// is root otherwise
+	Uid      int
+	Gid      int
+	HasOwner bool
+	// Don't include the target of a symlink, only the symlink itself
+	NoFollow bool
+	// Don't run any transforms on the file, e.g. stripping or compression
+	NoTransform bool
+}
+
 type File struct {
 	Source string
 	Dest   string
+	Attrs  Attributes
+	// The list file or directory that the file was listed in
+	Origin string
+	// If not nil, the file is generated with these contents instead of being
+	// copied from Source. Source is then only used to identify the file in
+	// the list.
+	Data []byte
 }
 
 type FileList struct {
-	m map[string]string
+	m map[string]File
 	sync.RWMutex
 }
 
 func NewFileList() *FileList {
 	return &FileList{
-		m: make(map[string]string),
+		m: make(map[string]File),
 	}
 }
 
 func (f *FileList) Add(src string, dest string) {
+	f.AddFile(File{
+		Source: src,
+		Dest:   dest,
+	})
+}
+
+// AddFile is like Add, but also keeps any attributes set on the given File.
+func (f *FileList) AddFile(file File) {
 	f.Lock()
 	defer f.Unlock()
 
-	f.m[src] = dest
+	f.m[file.Source] = file
 }
 
 func (f *FileList) Get(src string) (string, bool) {
 	f.RLock()
 	defer f.RUnlock()
 
-	dest, found := f.m[src]
-	return dest, found
+	file, found := f.m[src]
+	return file.Dest, found
 }
 
 // Import copies in the contents of src. If a source path already exists when
 // importing, then the destination path is updated with the new value.
 func (f *FileList) Import(src *FileList) {
 	for i := range src.IterItems() {
-		f.Add(i.Source, i.Dest)
+		f.AddFile(i)
+	}
+}
+
+// ImportFrom is like Import, but also sets the Origin of each imported file
+// that doesn't already have one.
+func (f *FileList) ImportFrom(src *FileList, origin string) {
+	for i := range src.IterItems() {
+		if i.Origin == "" {
+			i.Origin = origin
+		}
+		f.AddFile(i)
 	}
 }
 
@@ -53,11 +113,8 @@ func (f *FileList) IterItems() <-chan File {
 		f.RLock()
 		defer f.RUnlock()
 
-		for src, dest := range f.m {
-			ch <- File{
-				Source: src,
-				Dest:   dest,
-			}
+		for _, file := range f.m {
+			ch <- file
 		}
 		close(ch)
 	}()
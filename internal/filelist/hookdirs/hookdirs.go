@@ -9,17 +9,21 @@ import (
 	"strings"
 
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
 )
 
 type HookDirs struct {
-	path string
+	path    string
+	devinfo deviceinfo.DeviceInfo
 }
 
 // New returns a new HookDirs that will use the given path to provide a list
-// of directories use.
-func New(path string) *HookDirs {
+// of directories use. Conditions on lines are evaluated against the given
+// deviceinfo, see filelist.FilterConditions.
+func New(path string, devinfo deviceinfo.DeviceInfo) *HookDirs {
 	return &HookDirs{
-		path: path,
+		path:    path,
+		devinfo: devinfo,
 	}
 }
 
@@ -42,14 +46,22 @@ func (h *HookDirs) List() (*filelist.FileList, error) {
 		defer f.Close()
 		log.Printf("-- Creating directories from: %s\n", path)
 
-		s := bufio.NewScanner(f)
+		r, err := filelist.FilterConditions(f, h.devinfo)
+		if err != nil {
+			return nil, fmt.Errorf("getHookDirs: unable to process hook file %q: %w", path, err)
+		}
+		s := bufio.NewScanner(r)
 		for s.Scan() {
 			dir := strings.TrimSpace(s.Text())
 			if len(dir) == 0 || strings.HasPrefix(dir, "#") {
 				continue
 			}
 
-			files.Add(dir, dir)
+			files.AddFile(filelist.File{
+				Source: dir,
+				Dest:   dir,
+				Origin: path,
+			})
 		}
 	}
 	return files, nil
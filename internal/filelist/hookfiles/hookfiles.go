@@ -6,23 +6,29 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
 )
 
 type HookFiles struct {
 	filePath string
+	devinfo  deviceinfo.DeviceInfo
 }
 
 // New returns a new HookFiles that will use the given path to provide a list
-// of files + any binary dependencies they might have.
-func New(filePath string) *HookFiles {
+// of files + any binary dependencies they might have. Conditions on lines are
+// evaluated against the given deviceinfo, see filelist.FilterConditions.
+func New(filePath string, devinfo deviceinfo.DeviceInfo) *HookFiles {
 	return &HookFiles{
 		filePath: filePath,
+		devinfo:  devinfo,
 	}
 }
 
@@ -45,10 +51,14 @@ func (h *HookFiles) List() (*filelist.FileList, error) {
 		defer f.Close()
 		log.Printf("-- Including files from: %s\n", path)
 
-		if list, err := slurpFiles(f); err != nil {
+		r, err := filelist.FilterConditions(f, h.devinfo)
+		if err != nil {
+			return nil, fmt.Errorf("hookfiles: unable to process hook file %q: %w", path, err)
+		}
+		if list, err := slurpFiles(r); err != nil {
 			return nil, fmt.Errorf("hookfiles: unable to process hook file %q: %w", path, err)
 		} else {
-			files.Import(list)
+			files.ImportFrom(list, path)
 		}
 	}
 	return files, nil
@@ -65,11 +75,15 @@ func slurpFiles(fd io.Reader) (*filelist.FileList, error) {
 		}
 
 		src, dest, has_dest, is_optional := stripSuffix(line)
+		attrs, getOpts, err := parseOptions(line)
+		if err != nil {
+			return nil, err
+		}
 		if osutil.HasMergedUsr() {
 			src = osutil.MergeUsr(src)
 		}
 
-		fFiles, err := misc.GetFiles([]string{src}, true)
+		fFiles, err := misc.GetFilesWith([]string{src}, true, getOpts)
 		if err != nil {
 			// Ignore missing optional files, otherwise fail
 			if is_optional {
@@ -78,27 +92,221 @@ func slurpFiles(fd io.Reader) (*filelist.FileList, error) {
 				return nil, fmt.Errorf("unable to add %q: %w", src, err)
 			}
 		}
+		destPath := func(file string) string { return file }
+		if has_dest {
+			destPath = newDestMapper(src, dest)
+		}
+		matched, err := matchedFiles(src, fFiles, getOpts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to add %q: %w", src, err)
+		}
 		// loop over all returned files from GetFile
 		for _, file := range fFiles {
-			if !has_dest {
-				files.Add(file, file)
-			} else if len(fFiles) > 1 {
-				// Don't support specifying dest if src was a glob
-				// NOTE: this could support this later...
-				files.Add(file, file)
-			} else {
-				// dest path specified, and only 1 file
-				files.Add(file, dest)
+			f := filelist.File{
+				Source: file,
+				Dest:   destPath(file),
+			}
+			// options only apply to the files that the line lists, not
+			// to the libraries that they depend on
+			if matched[file] {
+				f.Attrs = attrs
 			}
+			files.AddFile(f)
 		}
 	}
 
 	return files, s.Err()
 }
 
+// matchedFiles returns the files out of the given ones that were found for
+// the source path itself, i.e. the files that it, the glob or the directory
+// matched, without the libraries that binaries depend on.
+func matchedFiles(src string, files []string, opts misc.GetFilesOptions) (map[string]bool, error) {
+	matched := make(map[string]bool)
+	if opts.NoDeps {
+		for _, file := range files {
+			matched[file] = true
+		}
+		return matched, nil
+	}
+	if len(files) == 0 {
+		return matched, nil
+	}
+
+	opts.NoDeps = true
+	found, err := misc.GetFilesWith([]string{src}, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range found {
+		matched[file] = true
+	}
+	return matched, nil
+}
+
+// newDestMapper returns a function that maps each file that was found for the
+// given source path to its destination path in the archive:
+//
+//   - if the source is a file, it's stored at dest
+//   - if the source is a directory, the files in it are stored under dest,
+//     keeping their path relative to the source
+//   - if the source is a glob, the matching files are stored under dest,
+//     keeping their path relative to the part of the glob before the first
+//     pattern, e.g. "/opt/fw/*/*.bin:/lib/firmware/" stores /opt/fw/a/b.bin at
+//     /lib/firmware/a/b.bin. If the glob matches exactly one file and dest
+//     doesn't end in "/", the file is stored at dest.
+//
+// Any other files, e.g. libraries that binaries depend on, are stored at
+// their source path.
+func newDestMapper(src string, dest string) func(string) string {
+	under := func(base string) func(string) string {
+		return func(file string) string {
+			rel, err := filepath.Rel(base, file)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return file
+			}
+			return filepath.Join(dest, rel)
+		}
+	}
+	single := func(src string) func(string) string {
+		return func(file string) string {
+			// files may have been found compressed, see misc.GetFiles
+			switch file {
+			case src, src + misc.ExtZstd, src + misc.ExtXz:
+				return dest
+			}
+			return file
+		}
+	}
+
+	if isGlob(src) {
+		matches, _ := filepath.Glob(src)
+		if len(matches) == 1 && !strings.HasSuffix(dest, "/") {
+			if info, err := os.Stat(matches[0]); err == nil && !info.IsDir() {
+				return single(matches[0])
+			}
+		}
+		return under(globBase(src))
+	}
+	if info, err := os.Stat(src); err == nil && info.IsDir() {
+		return under(src)
+	}
+	return single(src)
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[\\")
+}
+
+// globBase returns the directories at the start of the given glob that don't
+// contain a pattern, e.g. "/opt/fw" for "/opt/fw/*/*.bin"
+func globBase(glob string) string {
+	base := "/"
+	if !filepath.IsAbs(glob) {
+		base = "."
+	}
+	for _, part := range strings.Split(filepath.Dir(glob), "/") {
+		if isGlob(part) {
+			break
+		}
+		base = filepath.Join(base, part)
+	}
+	return base
+}
+
 func stripSuffix(line string) (string, string, bool, bool) {
-	// Ignore the second return as it will always be "option" or nothing
-	option_src, _, is_optional := strings.Cut(line, "!")
+	option_src, options, _ := strings.Cut(line, "!")
 	src, dest, has_dest := strings.Cut(option_src, ":")
+	is_optional := false
+	for _, o := range strings.Split(options, "!") {
+		if o == "optional" {
+			is_optional = true
+		}
+	}
 	return src, dest, has_dest, is_optional
 }
+
+// parseOptions returns the file attributes set by any "!option" suffixes on
+// the given line, and the options for finding the files it lists.
+func parseOptions(line string) (attrs filelist.Attributes, getOpts misc.GetFilesOptions, err error) {
+	_, options, found := strings.Cut(line, "!")
+	if !found {
+		return
+	}
+	for _, o := range strings.Split(options, "!") {
+		name, value, hasValue := strings.Cut(o, "=")
+		switch {
+		case o == "optional":
+			// handled by stripSuffix
+		case o == "strip":
+			attrs.Strip = filelist.StripAlways
+		case o == "nostrip":
+			attrs.Strip = filelist.StripNever
+		case o == "nodeps":
+			getOpts.NoDeps = true
+		case o == "nofollow":
+			attrs.NoFollow = true
+			getOpts.NoFollow = true
+		case o == "notransform":
+			attrs.NoTransform = true
+		case name == "mode" && hasValue:
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0o777 {
+				return attrs, getOpts, fmt.Errorf("invalid mode %q in line: %q", value, line)
+			}
+			attrs.Mode = os.FileMode(mode)
+			attrs.HasMode = true
+		case name == "owner" && hasValue:
+			if attrs.Uid, attrs.Gid, err = parseOwner(value); err != nil {
+				return attrs, getOpts, fmt.Errorf("invalid owner %q in line: %q: %w", value, line, err)
+			}
+			attrs.HasOwner = true
+		case name == "mode" || name == "owner":
+			return attrs, getOpts, fmt.Errorf("missing value for option %q in line: %q", o, line)
+		default:
+			log.Printf("-- Warning: ignoring unknown option %q in line: %q", o, line)
+		}
+	}
+	return
+}
+
+// parseOwner parses an owner in the form "user[:group]", where user and group
+// are either numeric IDs or names. Names are looked up on the host. If the
+// group isn't given, it is root (0), not the primary group of the user.
+func parseOwner(owner string) (uid int, gid int, err error) {
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+	if userName == "" {
+		return 0, 0, fmt.Errorf("missing user")
+	}
+	if hasGroup && groupName == "" {
+		return 0, 0, fmt.Errorf("missing group after \":\", omit the \":\" for group root")
+	}
+	if uid, err = strconv.Atoi(userName); err != nil {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, err
+		}
+	}
+	if uid < 0 {
+		return 0, 0, fmt.Errorf("negative uid: %d", uid)
+	}
+	if !hasGroup {
+		return uid, 0, nil
+	}
+	if gid, err = strconv.Atoi(groupName); err != nil {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, err
+		}
+	}
+	if gid < 0 {
+		return 0, 0, fmt.Errorf("negative gid: %d", gid)
+	}
+	return uid, gid, nil
+}
@@ -4,7 +4,17 @@
 package hookfiles
 
 import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
 )
 
 func TestStripSuffix(t *testing.T) {
@@ -19,6 +29,8 @@ func TestStripSuffix(t *testing.T) {
 		{"/foo/bar/bazz:/foo/bazz", "/foo/bar/bazz", "/foo/bazz", true, false},
 		{"/lentil/soup!optional", "/lentil/soup", "", false, true},
 		{"/lentil/soup:/carrot/soup!optional", "/lentil/soup", "/carrot/soup", true, true},
+		{"/lentil/soup!nostrip!optional", "/lentil/soup", "", false, true},
+		{"/lentil/soup:/carrot/soup!strip", "/lentil/soup", "/carrot/soup", true, false},
 	}
 	for _, table := range tables {
 		real_src, real_dest, real_has_dest, real_is_optional := stripSuffix(table.in)
@@ -36,3 +48,227 @@ func TestStripSuffix(t *testing.T) {
 		}
 	}
 }
+
+func TestParseOptions(t *testing.T) {
+	tables := []struct {
+		in              string
+		expected        filelist.Attributes
+		expectedGetOpts misc.GetFilesOptions
+		expectedError   bool
+	}{
+		{"/foo/bar/bazz", filelist.Attributes{}, misc.GetFilesOptions{}, false},
+		{"/foo/bar/bazz!optional", filelist.Attributes{}, misc.GetFilesOptions{}, false},
+		{"/foo/bar/bazz:/bazz!strip", filelist.Attributes{Strip: filelist.StripAlways}, misc.GetFilesOptions{}, false},
+		{"/foo/bar/bazz!optional!nostrip", filelist.Attributes{Strip: filelist.StripNever}, misc.GetFilesOptions{}, false},
+		// unknown options are ignored
+		{"/foo/bar/bazz!pear", filelist.Attributes{}, misc.GetFilesOptions{}, false},
+		{"/foo/bar/bazz!pear!nostrip", filelist.Attributes{Strip: filelist.StripNever}, misc.GetFilesOptions{}, false},
+		{"/etc/key:/key!mode=0600", filelist.Attributes{Mode: 0600, HasMode: true}, misc.GetFilesOptions{}, false},
+		{"/etc/key!mode=600!optional", filelist.Attributes{Mode: 0600, HasMode: true}, misc.GetFilesOptions{}, false},
+		{"/etc/key!mode=0999", filelist.Attributes{}, misc.GetFilesOptions{}, true},
+		{"/etc/key!mode=04755", filelist.Attributes{}, misc.GetFilesOptions{}, true},
+		{"/etc/key!mode", filelist.Attributes{}, misc.GetFilesOptions{}, true},
+		{"/etc/key!owner=1000", filelist.Attributes{Uid: 1000, HasOwner: true}, misc.GetFilesOptions{}, false},
+		{"/etc/key!owner=1000:100", filelist.Attributes{Uid: 1000, Gid: 100, HasOwner: true}, misc.GetFilesOptions{}, false},
+		{"/etc/key!owner=root:root", filelist.Attributes{HasOwner: true}, misc.GetFilesOptions{}, false},
+		{"/etc/key!owner=no-such-user-here", filelist.Attributes{}, misc.GetFilesOptions{}, true},
+		{"/etc/key!owner=1000:", filelist.Attributes{}, misc.GetFilesOptions{}, true},
+		{"/etc/key!owner=:100", filelist.Attributes{}, misc.GetFilesOptions{}, true},
+		{"/opt/blob!nodeps", filelist.Attributes{}, misc.GetFilesOptions{NoDeps: true}, false},
+		{"/usr/bin/sh!nofollow", filelist.Attributes{NoFollow: true}, misc.GetFilesOptions{NoFollow: true}, false},
+		{"/opt/blob!notransform!nodeps", filelist.Attributes{NoTransform: true}, misc.GetFilesOptions{NoDeps: true}, false},
+	}
+	for _, table := range tables {
+		attrs, getOpts, err := parseOptions(table.in)
+		if (err != nil) != table.expectedError {
+			t.Errorf("%q: unexpected error value: %v", table.in, err)
+			continue
+		}
+		if err == nil && attrs != table.expected {
+			t.Errorf("%q: expected: %+v, got: %+v", table.in, table.expected, attrs)
+		}
+		if err == nil && getOpts != table.expectedGetOpts {
+			t.Errorf("%q: expected: %+v, got: %+v", table.in, table.expectedGetOpts, getOpts)
+		}
+	}
+}
+
+func TestSlurpFilesDest(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{
+		"opt/vendor/fw/a.bin",
+		"opt/vendor/fw/b.bin",
+		"opt/vendor/fw/sub/c.bin",
+		"opt/vendor/fw/readme.txt",
+		"usr/share/foo/x.conf",
+		"usr/share/foo/nested/y.conf",
+		"usr/lib/libfoo.so.1.2",
+		"etc/single.conf",
+		"lib/firmware/compressed.fw.zst",
+	} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tables := []struct {
+		line     string
+		expected map[string]string
+	}{
+		{"opt/vendor/fw/*.bin:/lib/firmware/vendor/", map[string]string{
+			"opt/vendor/fw/a.bin": "/lib/firmware/vendor/a.bin",
+			"opt/vendor/fw/b.bin": "/lib/firmware/vendor/b.bin",
+		}},
+		// the relative structure after the first pattern is kept
+		{"opt/vendor/*/*/*.bin:/fw/", map[string]string{
+			"opt/vendor/fw/sub/c.bin": "/fw/fw/sub/c.bin",
+		}},
+		{"usr/share/foo:/foo", map[string]string{
+			"usr/share/foo/x.conf":        "/foo/x.conf",
+			"usr/share/foo/nested/y.conf": "/foo/nested/y.conf",
+		}},
+		// a glob matching one file is stored at dest, unless it's a dir
+		{"usr/lib/libfoo.so.*:/usr/lib/libfoo.so", map[string]string{
+			"usr/lib/libfoo.so.1.2": "/usr/lib/libfoo.so",
+		}},
+		{"usr/lib/libfoo.so.*:/usr/lib/foo/", map[string]string{
+			"usr/lib/libfoo.so.1.2": "/usr/lib/foo/libfoo.so.1.2",
+		}},
+		{"etc/single.conf:/etc/renamed.conf", map[string]string{
+			"etc/single.conf": "/etc/renamed.conf",
+		}},
+		{"lib/firmware/compressed.fw:/lib/firmware/renamed.fw", map[string]string{
+			"lib/firmware/compressed.fw.zst": "/lib/firmware/renamed.fw",
+		}},
+		{"etc/single.conf", map[string]string{
+			"etc/single.conf": filepath.Join(dir, "etc/single.conf"),
+		}},
+	}
+	for _, table := range tables {
+		out, err := slurpFiles(strings.NewReader(dir + "/" + table.line + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for f := range out.IterItems() {
+			rel, _ := filepath.Rel(dir, f.Source)
+			got[rel] = f.Dest
+		}
+		if !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.line, table.expected, got)
+		}
+	}
+}
+
+// fakeBinary returns a minimal ELF shared object that depends on the given
+// libraries
+func fakeBinary(t *testing.T, needed []string) []byte {
+	t.Helper()
+
+	dynstr := []byte("\x00")
+	var dynamic []elf.Dyn64
+	for _, lib := range needed {
+		dynamic = append(dynamic, elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: uint64(len(dynstr))})
+		dynstr = append(dynstr, lib+"\x00"...)
+	}
+	dynamic = append(dynamic, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	const ehdrSize = 64
+	const shdrSize = 64
+	const dynSize = 16
+	dynstrOff := uint64(ehdrSize)
+	dynamicOff := dynstrOff + uint64(len(dynstr))
+	shstrtabOff := dynamicOff + uint64(len(dynamic)*dynSize)
+	shOff := shstrtabOff + uint64(len(shstrtab))
+
+	var buf bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	hdr := elf.Header64{
+		Ident:     ident,
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shOff,
+		Ehsize:    ehdrSize,
+		Shentsize: shdrSize,
+		Shnum:     4,
+		Shstrndx:  3,
+	}
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Flags: uint64(elf.SHF_ALLOC), Off: dynstrOff, Size: uint64(len(dynstr)), Addralign: 1},
+		{Name: 9, Type: uint32(elf.SHT_DYNAMIC), Flags: uint64(elf.SHF_ALLOC), Off: dynamicOff, Size: uint64(len(dynamic) * dynSize), Link: 1, Addralign: 8, Entsize: dynSize},
+		{Name: 18, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	}
+
+	for _, v := range []any{hdr, dynstr, dynamic, shstrtab, sections} {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestSlurpFilesAttrs(t *testing.T) {
+	if _, err := os.Stat("/usr/lib"); err != nil {
+		t.Skip("libraries are only looked up relative to /usr/lib and /lib, which don't exist")
+	}
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib", "libdep.so")
+	bin := filepath.Join(dir, "bin", "tool")
+	// library paths are relative to the directories that libraries are
+	// searched in, starting with /usr/lib
+	files := map[string][]byte{
+		lib: fakeBinary(t, nil),
+		bin: fakeBinary(t, []string{filepath.Join("../..", lib)}),
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attrs := filelist.Attributes{Mode: 0700, HasMode: true, Uid: 1000, HasOwner: true, NoTransform: true}
+	tables := []struct {
+		line string
+		// source path -> expected attributes
+		expected map[string]filelist.Attributes
+	}{
+		{bin + ":/bin/tool!mode=0700!owner=1000!notransform", map[string]filelist.Attributes{
+			bin: attrs,
+			lib: {},
+		}},
+		{filepath.Join(dir, "bin") + "/*!mode=0700!owner=1000!notransform", map[string]filelist.Attributes{
+			bin: attrs,
+			lib: {},
+		}},
+		{filepath.Join(dir, "bin") + ":/bin!mode=0700!owner=1000!notransform", map[string]filelist.Attributes{
+			bin: attrs,
+			lib: {},
+		}},
+		{bin + "!mode=0700!owner=1000!notransform!nodeps", map[string]filelist.Attributes{
+			bin: attrs,
+		}},
+	}
+	for _, table := range tables {
+		out, err := slurpFiles(strings.NewReader(table.line + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]filelist.Attributes)
+		for f := range out.IterItems() {
+			got[f.Source] = f.Attrs
+		}
+		if !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %+v, got: %+v", table.line, table.expected, got)
+		}
+	}
+}
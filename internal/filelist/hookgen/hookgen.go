@@ -0,0 +1,158 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package hookgen
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+)
+
+// sourcePrefix is prepended to the destination path to make up the Source of
+// each generated file, so that it never collides with a real file that has the
+// same path as its source. Generated files with the same destination still
+// replace each other, e.g. one from a template in /etc/mkinitfs replaces one
+// from /usr/share/mkinitfs.
+const sourcePrefix = "generated:"
+
+type HookGen struct {
+	path    string
+	devinfo deviceinfo.DeviceInfo
+	data    templateData
+}
+
+// templateData is what templates can refer to, e.g. {{ .KernelVersion }}
+type templateData struct {
+	KernelVersion   string
+	MkinitfsVersion string
+}
+
+// New returns a new HookGen that generates files from the templates in the
+// given path. Templates can use the given deviceinfo, kernel version and
+// mkinitfs version.
+func New(path string, devinfo deviceinfo.DeviceInfo, kernVer string, mkinitfsVersion string) *HookGen {
+	return &HookGen{
+		path:    path,
+		devinfo: devinfo,
+		data: templateData{
+			KernelVersion:   kernVer,
+			MkinitfsVersion: mkinitfsVersion,
+		},
+	}
+}
+
+func (h *HookGen) List() (*filelist.FileList, error) {
+	log.Printf("- Searching for generated files from %s", h.path)
+
+	files := filelist.NewFileList()
+	fileInfo, err := os.ReadDir(h.path)
+	if err != nil {
+		log.Println("-- Unable to find dir, skipping...")
+		return files, nil
+	}
+	for _, file := range fileInfo {
+		path := filepath.Join(h.path, file.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("hookgen: unable to open template: %w", err)
+		}
+		defer f.Close()
+
+		gen, err := h.generate(f, path)
+		if err != nil {
+			return nil, fmt.Errorf("hookgen: unable to process template %q: %w", path, err)
+		}
+		log.Printf("-- Generating %s from: %s\n", gen.Dest, path)
+		files.AddFile(gen)
+	}
+	return files, nil
+}
+
+// generate returns the file generated from the given template. The first line
+// that isn't empty or a comment is the destination path, optionally followed
+// by "!mode=<octal mode>", and everything after it is the template for the
+// contents.
+func (h *HookGen) generate(fd io.Reader, name string) (filelist.File, error) {
+	gen := filelist.File{Origin: name}
+
+	r := bufio.NewReader(fd)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return gen, err
+		}
+		line = strings.TrimSpace(line)
+		if len(line) != 0 && !strings.HasPrefix(line, "#") {
+			if gen.Dest, gen.Attrs, err = parseDest(line); err != nil {
+				return gen, err
+			}
+			break
+		}
+		if err == io.EOF {
+			return gen, fmt.Errorf("no destination path found")
+		}
+	}
+	gen.Source = sourcePrefix + gen.Dest
+
+	text, err := io.ReadAll(r)
+	if err != nil {
+		return gen, err
+	}
+	tmpl, err := template.New(name).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{
+			// the value of the given deviceinfo variable, or an empty
+			// string if it isn't set
+			"deviceinfo": func(name string) string {
+				v, _ := h.devinfo.Value(name)
+				return v
+			},
+		}).
+		Parse(string(text))
+	if err != nil {
+		return gen, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, h.data); err != nil {
+		return gen, err
+	}
+	// Data must not be nil for an empty file
+	gen.Data = append([]byte{}, buf.Bytes()...)
+
+	return gen, nil
+}
+
+func parseDest(line string) (dest string, attrs filelist.Attributes, err error) {
+	dest, options, _ := strings.Cut(line, "!")
+	if !filepath.IsAbs(dest) {
+		return "", attrs, fmt.Errorf("destination must be an absolute path: %q", dest)
+	}
+	for _, o := range strings.Split(options, "!") {
+		name, value, _ := strings.Cut(o, "=")
+		switch {
+		case o == "":
+		case name == "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0o777 {
+				return "", attrs, fmt.Errorf("invalid mode %q in line: %q", value, line)
+			}
+			attrs.Mode = os.FileMode(mode)
+			attrs.HasMode = true
+		default:
+			return "", attrs, fmt.Errorf("unknown option %q in line: %q", o, line)
+		}
+	}
+	return filepath.Clean(dest), attrs, nil
+}
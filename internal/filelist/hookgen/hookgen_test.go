@@ -0,0 +1,103 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package hookgen
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
+)
+
+func TestGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deviceinfo")
+	contents := "deviceinfo_format_version=\"0\"\ndeviceinfo_codename=\"pine64-pinephone\"\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var devinfo deviceinfo.DeviceInfo
+	if err := devinfo.ReadDeviceinfo(path); err != nil {
+		t.Fatal(err)
+	}
+	h := New("", devinfo, "6.6.0", "2.0")
+
+	tables := []struct {
+		in            string
+		expected      filelist.File
+		expectedError bool
+	}{
+		{"/etc/hostname\n{{ deviceinfo \"deviceinfo_codename\" }}\n",
+			filelist.File{Source: "generated:/etc/hostname", Dest: "/etc/hostname", Data: []byte("pine64-pinephone\n")}, false},
+		{"# comment\n\n/etc/mkinitfs.conf!mode=0600\n# kept\nkernel={{ .KernelVersion }} mkinitfs={{ .MkinitfsVersion }} unset={{ deviceinfo \"deviceinfo_unset\" }}\n",
+			filelist.File{Source: "generated:/etc/mkinitfs.conf", Dest: "/etc/mkinitfs.conf", Attrs: filelist.Attributes{Mode: 0600, HasMode: true},
+				Data: []byte("# kept\nkernel=6.6.0 mkinitfs=2.0 unset=\n")}, false},
+		{"/etc/empty\n", filelist.File{Source: "generated:/etc/empty", Dest: "/etc/empty", Data: []byte{}}, false},
+		{"# only a comment\n", filelist.File{}, true},
+		{"etc/hostname\nfoo\n", filelist.File{}, true},
+		{"/etc/hostname!owner=0\nfoo\n", filelist.File{}, true},
+		{"/etc/hostname\n{{ .Foo }}\n", filelist.File{}, true},
+		{"/etc/hostname\n{{ deviceinfo }\n", filelist.File{}, true},
+	}
+	for _, table := range tables {
+		gen, err := h.generate(strings.NewReader(table.in), "test")
+		if (err != nil) != table.expectedError {
+			t.Errorf("%q: unexpected error value: %v", table.in, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if gen.Source != table.expected.Source || gen.Dest != table.expected.Dest || gen.Attrs != table.expected.Attrs {
+			t.Errorf("%q: expected: %+v, got: %+v", table.in, table.expected, gen)
+		}
+		if gen.Data == nil || string(gen.Data) != string(table.expected.Data) {
+			t.Errorf("%q: expected data: %q, got: %q", table.in, table.expected.Data, gen.Data)
+		}
+	}
+}
+
+func TestGenerateSourceCollision(t *testing.T) {
+	h := New("", deviceinfo.DeviceInfo{}, "6.6.0", "2.0")
+	generate := func(in string, name string) filelist.File {
+		gen, err := h.generate(strings.NewReader(in), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gen
+	}
+
+	// a real file with the same path as the generated ones, e.g. from a
+	// line "/etc/hostname:/etc/hostname.orig" in a .files list
+	files := filelist.NewFileList()
+	files.Add("/etc/hostname", "/etc/hostname.orig")
+	files.AddFile(generate("/etc/hostname\nfoo\n", "/usr/share/mkinitfs/gen/hostname"))
+	files.AddFile(generate("/etc/hostname\nbar\n", "/etc/mkinitfs/gen/hostname"))
+
+	expected := map[string]string{
+		"/etc/hostname":           "/etc/hostname.orig",
+		"generated:/etc/hostname": "/etc/hostname",
+	}
+	got := make(map[string]string)
+	for f := range files.IterItems() {
+		got[f.Source] = f.Dest
+		if f.Data != nil && string(f.Data) != "bar\n" {
+			t.Errorf("expected the file generated last to replace the others, got: %q", f.Data)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %q, got: %q", expected, got)
+	}
+
+	// a generated file isn't excluded by a real file with the same path in
+	// another archive, see archive.AddItemsExclude
+	other := filelist.NewFileList()
+	other.Add("/etc/hostname", "/etc/hostname")
+	if _, found := other.Get(generate("/etc/hostname\n", "test").Source); found {
+		t.Errorf("generated file matches a real file with the same path")
+	}
+}
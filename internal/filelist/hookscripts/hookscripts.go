@@ -36,7 +36,11 @@ func (h *HookScripts) List() (*filelist.FileList, error) {
 	for _, file := range fileInfo {
 		path := filepath.Join(h.scriptsDir, file.Name())
 		log.Printf("-- Including script: %s\n", path)
-		files.Add(path, filepath.Join(h.destPath, file.Name()))
+		files.AddFile(filelist.File{
+			Source: path,
+			Dest:   filepath.Join(h.destPath, file.Name()),
+			Origin: h.scriptsDir,
+		})
 	}
 	return files, nil
 }
@@ -0,0 +1,109 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// builtinModules are the modules that are built into a kernel, according to
+// modules.builtin and modules.builtin.modinfo in its modules dir
+type builtinModules struct {
+	names map[string]bool
+	// aliases of the built-in modules, from modules.builtin.modinfo
+	aliases *aliasIndex
+}
+
+// loadBuiltinModules returns the built-in modules for the given modules dir.
+// The files are only read once for each dir. Files that don't exist are
+// treated as empty, e.g. older kernels don't have modules.builtin.modinfo.
+func (c *Config) loadBuiltinModules(modDir string) (*builtinModules, error) {
+	c.builtinsMu.Lock()
+	defer c.builtinsMu.Unlock()
+
+	if b, found := c.builtins[modDir]; found {
+		return b, nil
+	}
+
+	b := &builtinModules{
+		names: make(map[string]bool),
+		aliases: &aliasIndex{
+			patterns: make(map[string][]aliasPattern),
+		},
+	}
+
+	// lines are paths of modules, e.g. "kernel/fs/ext4/ext4.ko"
+	builtinPath := filepath.Join(modDir, "modules.builtin")
+	if fd, err := os.Open(builtinPath); err == nil {
+		defer fd.Close()
+		s := bufio.NewScanner(fd)
+		for s.Scan() {
+			if line := strings.TrimSpace(s.Text()); line != "" {
+				b.names[moduleName(line)] = true
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read %q: %w", builtinPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to open %q: %w", builtinPath, err)
+	}
+
+	modinfoPath := filepath.Join(modDir, "modules.builtin.modinfo")
+	data, err := os.ReadFile(modinfoPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read %q: %w", modinfoPath, err)
+	}
+	b.parseModinfo(data)
+
+	if c.builtins == nil {
+		c.builtins = make(map[string]*builtinModules)
+	}
+	c.builtins[modDir] = b
+	return b, nil
+}
+
+// parseModinfo reads modules.builtin.modinfo, which is a list of
+// NUL-terminated <module>.<key>=<value> strings
+func (b *builtinModules) parseModinfo(data []byte) {
+	for _, field := range bytes.Split(data, []byte{0}) {
+		key, value, found := strings.Cut(string(field), "=")
+		if !found {
+			continue
+		}
+		name, key, found := strings.Cut(key, ".")
+		if !found {
+			continue
+		}
+		name = moduleName(name)
+		b.names[name] = true
+		if key == "alias" {
+			b.aliases.add(value, name)
+		}
+	}
+}
+
+// isBuiltin returns true if the module with the given name is built in
+func (b *builtinModules) isBuiltin(name string) bool {
+	return b.names[moduleName(name)]
+}
+
+// match returns the names of the built-in modules that match the given shell
+// pattern, see DepIndex.Match
+func (b *builtinModules) match(pattern string) (names []string) {
+	pattern = moduleNamePattern(pattern)
+	for name := range b.names {
+		if fnmatch(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
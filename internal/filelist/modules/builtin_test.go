@@ -0,0 +1,73 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSlurpModulesBuiltin(t *testing.T) {
+	files := modDirFiles(t, "kernel/lib/crc16.ko:\n")
+	files["modules.builtin"] = "kernel/fs/ext4/ext4.ko\nkernel/drivers/mmc/core/mmc_core.ko\n"
+	files["modules.builtin.modinfo"] = "ext4.alias=fs-ext4\x00ext4.license=GPL\x00" +
+		"sdhci_msm.alias=of:N*T*Cqcom,sdhci-msm-v4\x00sdhci_msm.license=GPL v2\x00"
+	modDir := writeModTree(t, files)
+
+	tables := []struct {
+		list   string
+		strict bool
+		err    string
+	}{
+		{"ext4\n", true, ""},
+		{"mmc-core\n", true, ""},
+		// only in modules.builtin.modinfo
+		{"sdhci-msm\n", true, ""},
+		{"fs-ext4\n", true, ""},
+		{"of:NsdhciT(null)Cqcom,sdhci-msm-v4\n", true, ""},
+		{"mmc_*\n", true, ""},
+		{"crc16\n\nexp4\n", true, "line 3: module \"exp4\" is neither a loadable module nor built into the kernel"},
+		{"exp4\n", false, ""},
+		{"exp4!optional\n", true, ""},
+	}
+	for _, table := range tables {
+		out, err := slurpModules(&Config{}, strings.NewReader(table.list), modDir, nil, table.strict)
+		if table.err != "" {
+			if err == nil || err.Error() != table.err {
+				t.Errorf("%q: expected error %q, got: %v", table.list, table.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", table.list, err)
+			continue
+		}
+		var got []string
+		for f := range out.IterItems() {
+			got = append(got, f.Source)
+		}
+		if len(got) != 0 {
+			t.Errorf("%q: expected no files, got: %q", table.list, got)
+		}
+	}
+}
+
+func TestBuiltinModulesParseModinfo(t *testing.T) {
+	b := &builtinModules{
+		names: make(map[string]bool),
+		aliases: &aliasIndex{
+			patterns: make(map[string][]aliasPattern),
+		},
+	}
+	b.parseModinfo([]byte("ext4.alias=fs-ext4\x00ext4.alias=fs-ext3\x00dw-wdt.license=GPL\x00garbage\x00"))
+
+	if !b.isBuiltin("ext4") || !b.isBuiltin("dw_wdt") || b.isBuiltin("garbage") {
+		t.Errorf("unexpected built-in modules: %v", b.names)
+	}
+	expected := []string{"ext4"}
+	if got := b.aliases.match("fs-ext3"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %q, got: %q", expected, got)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
+)
+
+// Compression is the format kernel modules are stored in within the archive
+type Compression string
+
+const (
+	// Modules are stored in the format they have on the system
+	CompressionKeep Compression = "keep"
+	// Modules are stored decompressed
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionXz   Compression = "xz"
+	CompressionZstd Compression = "zstd"
+)
+
+// KernelSupport returns an error if a kernel with the given config can't load
+// the kernel modules in the given list of files, stored with the given
+// compression. With CompressionKeep, the compression of each module is taken
+// from its extension. The kernel only decompresses modules itself when
+// CONFIG_MODULE_DECOMPRESS is set, otherwise it's up to modprobe.
+func KernelSupport(config osutil.KernelConfig, files []string, c Compression) error {
+	var modules []string
+	for _, file := range files {
+		if isModule(file) {
+			modules = append(modules, file)
+		}
+	}
+	if len(modules) == 0 {
+		return nil
+	}
+
+	if !config.BuiltIn("CONFIG_MODULES") {
+		return fmt.Errorf("kernel doesn't support loadable modules, CONFIG_MODULES is not set, but %d modules are included, e.g. %q", len(modules), modules[0])
+	}
+	if !config.BuiltIn("CONFIG_MODULE_DECOMPRESS") {
+		return nil
+	}
+	for _, module := range modules {
+		format := c
+		if format == CompressionKeep {
+			format = compressionOf(module)
+		}
+		if format == CompressionNone {
+			continue
+		}
+		if option := "CONFIG_MODULE_COMPRESS_" + strings.ToUpper(string(format)); !config.BuiltIn(option) {
+			return fmt.Errorf("kernel can't decompress modules compressed with %s, %s is not set, e.g. %q", format, option, module)
+		}
+	}
+	return nil
+}
+
+// compressionOf returns the Compression of the given module file, based on
+// its extension
+func compressionOf(file string) Compression {
+	switch misc.CompressionExt(file) {
+	case misc.ExtGzip:
+		return CompressionGzip
+	case misc.ExtXz:
+		return CompressionXz
+	case misc.ExtZstd:
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+var moduleRe = regexp.MustCompile(`\.ko(\.gz|\.xz|\.zst)?$`)
+
+// ExtractCompression parses the given string into a Compression. If the
+// string is empty or the format is unknown, CompressionKeep is returned.
+func ExtractCompression(s string) Compression {
+	c := Compression(strings.ToLower(s))
+	switch c {
+	case CompressionKeep, CompressionNone, CompressionGzip, CompressionXz, CompressionZstd:
+	case "":
+		c = CompressionKeep
+	default:
+		log.Printf("Unknown module compression format %q, keeping modules as-is", s)
+		c = CompressionKeep
+	}
+	return c
+}
+
+// Ext returns the file extension used for modules in this format, not
+// including the ".ko" part.
+func (c Compression) Ext() string {
+	switch c {
+	case CompressionGzip:
+		return misc.ExtGzip
+	case CompressionXz:
+		return misc.ExtXz
+	case CompressionZstd:
+		return misc.ExtZstd
+	}
+	return ""
+}
+
+// CompressionTransform is an archive Transform that converts kernel modules to
+// the given Compression format as they are added to the archive. Module
+// metadata files that reference module file names (modules.dep and
+// modules.dep.bin) are rewritten to use the new file names.
+type CompressionTransform struct {
+	format Compression
+}
+
+// NewCompressionTransform returns a new CompressionTransform for the given format
+func NewCompressionTransform(format Compression) *CompressionTransform {
+	return &CompressionTransform{
+		format: format,
+	}
+}
+
+func (c *CompressionTransform) Rename(f filelist.File) string {
+	if c.format == CompressionKeep || !isModule(f.Dest) {
+		return f.Dest
+	}
+	return c.rename(f.Dest)
+}
+
+func (c *CompressionTransform) Match(f filelist.File) bool {
+	if c.format == CompressionKeep {
+		return false
+	}
+	if isModule(f.Dest) {
+		return misc.CompressionExt(f.Source) != misc.CompressionExt(f.Dest)
+	}
+	switch filepath.Base(f.Dest) {
+	case "modules.dep", "modules.dep.bin":
+		return true
+	}
+	return false
+}
+
+func (c *CompressionTransform) Apply(f filelist.File, data []byte) ([]byte, error) {
+	if isModule(f.Dest) {
+		data, err := misc.Decompress(misc.CompressionExt(f.Source), data)
+		if err != nil {
+			return nil, err
+		}
+		return misc.Compress(misc.CompressionExt(f.Dest), data)
+	}
+
+	switch filepath.Base(f.Dest) {
+	case "modules.dep":
+		return c.renameModulesDep(data)
+	case "modules.dep.bin":
+		// Regenerated from the text version, since kmod uses this one
+		text, err := os.ReadFile(filepath.Join(filepath.Dir(f.Source), "modules.dep"))
+		if err != nil {
+			return nil, err
+		}
+		text, err = c.renameModulesDep(text)
+		if err != nil {
+			return nil, err
+		}
+		return modulesDepIndex(text)
+	}
+
+	return data, nil
+}
+
+// rename returns the given module file name with the extension for the
+// configured format.
+func (c *CompressionTransform) rename(file string) string {
+	return strings.TrimSuffix(file, misc.CompressionExt(file)) + c.format.Ext()
+}
+
+// renameModulesDep rewrites all module paths in the given modules.dep contents
+// to use the extension for the configured format.
+func (c *CompressionTransform) renameModulesDep(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		for i, field := range fields {
+			name, hasColon := strings.CutSuffix(field, ":")
+			if isModule(name) {
+				name = c.rename(name)
+			}
+			if hasColon {
+				name += ":"
+			}
+			fields[i] = name
+		}
+		out.WriteString(strings.Join(fields, " "))
+		out.WriteByte('\n')
+	}
+
+	return out.Bytes(), s.Err()
+}
+
+// modulesDepIndex generates modules.dep.bin from the given modules.dep
+// contents.
+func modulesDepIndex(modulesDep []byte) ([]byte, error) {
+	idx := newKmodIndex()
+	s := bufio.NewScanner(bytes.NewReader(modulesDep))
+	var priority uint32
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path, _, _ := strings.Cut(line, ":")
+		if err := idx.insert(moduleName(path), line, priority); err != nil {
+			return nil, err
+		}
+		priority++
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return idx.Bytes(), nil
+}
+
+func isModule(file string) bool {
+	return moduleRe.MatchString(file)
+}
+
+// moduleName returns the name of the module at the given path, the way kmod
+// represents it, e.g. "kernel/foo/dw-wdt.ko.xz" is "dw_wdt"
+func moduleName(path string) string {
+	return strings.ReplaceAll(stripExts(filepath.Base(path)), "-", "_")
+}
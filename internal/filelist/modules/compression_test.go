@@ -0,0 +1,204 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cavaliergopher/cpio"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/archive"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
+)
+
+func TestCompressionTransformRename(t *testing.T) {
+	tables := []struct {
+		format   Compression
+		in       string
+		expected string
+	}{
+		{CompressionNone, "/lib/modules/6.1/kernel/foo.ko.zst", "/lib/modules/6.1/kernel/foo.ko"},
+		{CompressionNone, "/lib/modules/6.1/kernel/foo.ko", "/lib/modules/6.1/kernel/foo.ko"},
+		{CompressionXz, "/lib/modules/6.1/kernel/foo.ko.gz", "/lib/modules/6.1/kernel/foo.ko.xz"},
+		{CompressionZstd, "/lib/modules/6.1/kernel/foo.ko", "/lib/modules/6.1/kernel/foo.ko.zst"},
+		{CompressionKeep, "/lib/modules/6.1/kernel/foo.ko.gz", "/lib/modules/6.1/kernel/foo.ko.gz"},
+		{CompressionNone, "/lib/firmware/foo.bin.zst", "/lib/firmware/foo.bin.zst"},
+	}
+	for _, table := range tables {
+		c := NewCompressionTransform(table.format)
+		out := c.Rename(filelist.File{Source: table.in, Dest: table.in})
+		if out != table.expected {
+			t.Errorf("%s: expected: %q, got: %q", table.format, table.expected, out)
+		}
+	}
+}
+
+func TestCompressionTransformArchive(t *testing.T) {
+	module := []byte("\x7fELF not really a kernel module")
+	compressed, err := misc.Compress(misc.ExtZstd, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "foo.ko.zst")
+	if err := os.WriteFile(src, compressed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := archive.New(archive.FormatNone, archive.LevelDefault)
+	a.AddTransform(NewCompressionTransform(CompressionNone))
+	if err := a.AddItem(src, "/lib/modules/6.1/kernel/foo.ko.zst"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "initramfs")
+	if err := a.Write(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	expectedName := "lib/modules/6.1/kernel/foo.ko"
+	if osutil.HasMergedUsr() {
+		expectedName = "usr/" + expectedName
+	}
+	found := false
+	r := cpio.NewReader(fd)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("unable to read archive: ", err)
+		}
+		if hdr.Name != expectedName {
+			continue
+		}
+		found = true
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal("unable to read archive: ", err)
+		}
+		if !bytes.Equal(data, module) {
+			t.Errorf("expected decompressed module in archive, got: %q", data)
+		}
+	}
+	if !found {
+		t.Errorf("%q not found in archive", expectedName)
+	}
+}
+
+func TestCompressionTransformModulesDep(t *testing.T) {
+	c := NewCompressionTransform(CompressionNone)
+	out, err := c.renameModulesDep([]byte(testModuleDep))
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	expected := []string{"kernel/drivers/watchdog/dw_wdt.ko", "kernel/drivers/watchdog/watchdog.ko"}
+	idx, err := ParseModulesDep(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	deps, err := idx.Resolve("dw_wdt")
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Errorf("expected: %q, got: %q", expected, deps)
+	}
+
+	index, err := modulesDepIndex(out)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+	values := kmodIndexLookup(t, index, "dw_wdt")
+	expected = []string{"kernel/drivers/watchdog/dw_wdt.ko: kernel/drivers/watchdog/watchdog.ko"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected: %q, got: %q", expected, values)
+	}
+}
+
+func TestCompressionTransformApply(t *testing.T) {
+	module := []byte("\x7fELF not really a kernel module")
+	compressed, err := misc.Compress(misc.ExtZstd, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "foo.ko.zst")
+	if err := os.WriteFile(src, compressed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []Compression{CompressionNone, CompressionGzip, CompressionXz} {
+		c := NewCompressionTransform(format)
+		f := filelist.File{Source: src, Dest: "/lib/modules/6.1/foo.ko.zst"}
+		f.Dest = c.Rename(f)
+		if !c.Match(f) {
+			t.Errorf("%s: expected transform to match %q", format, f.Dest)
+			continue
+		}
+		out, err := c.Apply(f, compressed)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", format, err)
+			continue
+		}
+		out, err = misc.Decompress(format.Ext(), out)
+		if err != nil {
+			t.Errorf("%s: unable to decompress output: %s", format, err)
+			continue
+		}
+		if !bytes.Equal(out, module) {
+			t.Errorf("%s: module contents don't match", format)
+		}
+	}
+
+	c := NewCompressionTransform(CompressionZstd)
+	if c.Match(filelist.File{Source: src, Dest: "/lib/modules/6.1/foo.ko.zst"}) {
+		t.Error("expected module already in the right format not to match")
+	}
+}
+
+func TestKernelSupport(t *testing.T) {
+	modular := osutil.KernelConfig{"CONFIG_MODULES": "y"}
+	decompress := osutil.KernelConfig{
+		"CONFIG_MODULES":              "y",
+		"CONFIG_MODULE_DECOMPRESS":    "y",
+		"CONFIG_MODULE_COMPRESS_ZSTD": "y",
+	}
+	files := []string{"/bin/sh", "/lib/modules/6.1/kernel/foo.ko.zst"}
+
+	tables := []struct {
+		config   osutil.KernelConfig
+		files    []string
+		c        Compression
+		expected bool
+	}{
+		{osutil.KernelConfig{}, []string{"/bin/sh"}, CompressionXz, true},
+		{osutil.KernelConfig{}, files, CompressionKeep, false},
+		{modular, files, CompressionKeep, true},
+		// decompressed by modprobe
+		{modular, files, CompressionXz, true},
+		{decompress, files, CompressionZstd, true},
+		{decompress, files, CompressionNone, true},
+		{decompress, files, CompressionXz, false},
+		// kept modules are checked by their extension
+		{decompress, files, CompressionKeep, true},
+		{decompress, []string{"/lib/modules/6.1/kernel/foo.ko.xz"}, CompressionKeep, false},
+		{decompress, []string{"/lib/modules/6.1/kernel/foo.ko"}, CompressionKeep, true},
+		{modular, []string{"/lib/modules/6.1/kernel/foo.ko.xz"}, CompressionKeep, true},
+	}
+	for _, table := range tables {
+		err := KernelSupport(table.config, table.files, table.c)
+		if (err == nil) != table.expected {
+			t.Errorf("%v, %q, %s: expected supported: %t, got: %v", table.config, table.files, table.c, table.expected, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Config is the configuration on the system that modules are included from,
+// and a cache of the module indexes, modinfo, host modules and kernel configs
+// that have been read with it. Everything that includes modules from the same
+// system should share one Config, so that files are only read once, and a new
+// Config reads them again. The zero value doesn't read any modprobe.d or depmod.d
+// configuration, and doesn't include firmware, see DefaultConfig.
+type Config struct {
+	// directories that modprobe reads configuration from, in order of
+	// priority. A file in one directory overrides files with the same name
+	// in the directories after it.
+	ModprobeDirs []string
+	// like ModprobeDirs, but for depmod
+	DepmodDirs []string
+	// base directory that the kernel loads firmware from
+	FirmwareDir string
+
+	depIndexes     map[string]*DepIndex
+	depIndexesMu   sync.Mutex
+	aliasIndexes   map[string]*aliasIndex
+	aliasIndexesMu sync.Mutex
+	builtins       map[string]*builtinModules
+	builtinsMu     sync.Mutex
+	modinfo        map[string]map[string][]string
+	modinfoMu      sync.Mutex
+	hostModules    map[string]map[string]bool
+	hostModulesMu  sync.Mutex
+	signatures     map[string]bool
+	signaturesMu   sync.Mutex
+}
+
+// DefaultConfig returns a Config with the directories that modprobe, depmod
+// and the kernel use by default.
+func DefaultConfig() *Config {
+	return &Config{
+		ModprobeDirs: []string{
+			"/etc/modprobe.d",
+			"/run/modprobe.d",
+			"/usr/local/lib/modprobe.d",
+			"/usr/lib/modprobe.d",
+			"/lib/modprobe.d",
+		},
+		DepmodDirs: []string{
+			"/etc/depmod.d",
+			"/run/depmod.d",
+			"/usr/local/lib/depmod.d",
+			"/usr/lib/depmod.d",
+			"/lib/depmod.d",
+		},
+		FirmwareDir: "/lib/firmware",
+	}
+}
+
+// depIndexKey returns the key that the DepIndex for the given modules dir is
+// cached with. The index depends on the modprobe.d and depmod.d configuration
+// too, so the dirs they are read from are part of the key.
+func (c *Config) depIndexKey(modDir string) string {
+	return fmt.Sprintf("%s\x00%q\x00%q", modDir, c.ModprobeDirs, c.DepmodDirs)
+}
@@ -0,0 +1,110 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// defaultDepmodSearch is the search order for modules dir subdirectories when
+// there are no "search" lines in depmod.d, the same as depmod's. "built-in" is
+// the keyword for the modules that are installed with the kernel, and every
+// other subdirectory, including extra/.
+var defaultDepmodSearch = []string{"updates", "built-in"}
+
+// depmodConfig is the configuration from depmod.d files that decides which
+// copy of a module is used when it is in the modules dir more than once
+type depmodConfig struct {
+	// subdirectories of the modules dir, in order of priority
+	search []string
+	// module name -> subdirectory that the module is picked from
+	overrides map[string]string
+}
+
+func newDepmodConfig() *depmodConfig {
+	return &depmodConfig{
+		overrides: make(map[string]string),
+	}
+}
+
+// readDepmodConfig reads all *.conf files in the given directories, see
+// configFiles. Only "override" lines that apply to the given kernel version
+// are used.
+func readDepmodConfig(dirs []string, kernVer string) (*depmodConfig, error) {
+	cfg := newDepmodConfig()
+	for _, path := range configFiles(dirs) {
+		fd, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %q: %w", path, err)
+		}
+		err = cfg.parse(fd, kernVer)
+		fd.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %q: %w", path, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// parse reads depmod.d configuration from r. Only the search and override
+// commands are supported, anything else is ignored.
+func (cfg *depmodConfig) parse(r io.Reader, kernVer string) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "search":
+			cfg.search = append(cfg.search, fields[1:]...)
+		case "override":
+			// override <module> <kernel version> <subdirectory>
+			if len(fields) != 4 {
+				return fmt.Errorf("invalid override: %q", s.Text())
+			}
+			if fnmatch(fields[2], kernVer) {
+				cfg.overrides[moduleName(fields[1])] = strings.Trim(fields[3], "/")
+			}
+		}
+	}
+
+	return s.Err()
+}
+
+// priority returns the priority of the copy of the given module at the given
+// path, relative to the modules dir. Lower is better.
+func (cfg *depmodConfig) priority(name string, path string) int {
+	if subdir, found := cfg.overrides[moduleName(name)]; found && inSubdir(path, subdir) {
+		return -1
+	}
+
+	search := cfg.search
+	if len(search) == 0 {
+		search = defaultDepmodSearch
+	}
+	builtin := len(search)
+	for i, subdir := range search {
+		if subdir == "built-in" {
+			if builtin == len(search) {
+				builtin = i
+			}
+			continue
+		}
+		if inSubdir(path, subdir) {
+			return i
+		}
+	}
+	return builtin
+}
+
+func inSubdir(path string, subdir string) bool {
+	return strings.HasPrefix(path, strings.Trim(subdir, "/")+"/")
+}
@@ -0,0 +1,100 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testDuplicateModuleDep = `kernel/drivers/net/wireless/wcn36xx.ko: kernel/drivers/net/wireless/ath.ko
+kernel/drivers/net/wireless/ath.ko:
+extra/wcn36xx.ko: extra/ath.ko
+extra/ath.ko:
+updates/dkms/ath.ko:
+vendor/wcn36xx.ko:
+`
+
+func TestDepmodConfigPriority(t *testing.T) {
+	tables := []struct {
+		conf     string
+		kernVer  string
+		expected map[string][]string
+	}{
+		// default search order: updates, then everything else. extra/ has
+		// the same priority as kernel/, so the copy that is first in
+		// modules.dep is picked.
+		{"", "6.1.0", map[string][]string{
+			"wcn36xx": {"kernel/drivers/net/wireless/wcn36xx.ko", "updates/dkms/ath.ko"},
+			"ath":     {"updates/dkms/ath.ko"},
+		}},
+		{"search extra built-in\n", "6.1.0", map[string][]string{
+			"wcn36xx": {"extra/wcn36xx.ko", "extra/ath.ko"},
+		}},
+		{"search vendor built-in\n", "6.1.0", map[string][]string{
+			"wcn36xx": {"vendor/wcn36xx.ko"},
+			"ath":     {"kernel/drivers/net/wireless/ath.ko"},
+		}},
+		{"search built-in updates\n", "6.1.0", map[string][]string{
+			"wcn36xx": {"kernel/drivers/net/wireless/wcn36xx.ko", "kernel/drivers/net/wireless/ath.ko"},
+		}},
+		{"# comment\noverride wcn36xx * vendor\noverride ath 6.1.* kernel\n", "6.1.0", map[string][]string{
+			"wcn36xx": {"vendor/wcn36xx.ko"},
+			"ath":     {"kernel/drivers/net/wireless/ath.ko"},
+		}},
+		// override for another kernel version
+		{"override ath 5.* kernel\n", "6.1.0", map[string][]string{
+			"ath": {"updates/dkms/ath.ko"},
+		}},
+	}
+	for _, table := range tables {
+		idx, err := ParseModulesDep(strings.NewReader(testDuplicateModuleDep))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := newDepmodConfig()
+		if err := cfg.parse(strings.NewReader(table.conf), table.kernVer); err != nil {
+			t.Fatal(err)
+		}
+		idx.selectPaths(cfg)
+		for name, expected := range table.expected {
+			out, err := idx.Resolve(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, expected) {
+				t.Errorf("%q: %s: expected: %q, got: %q", table.conf, name, expected, out)
+			}
+		}
+	}
+
+	cfg := newDepmodConfig()
+	if err := cfg.parse(strings.NewReader("override ath\n"), "6.1.0"); err == nil {
+		t.Error("expected error for invalid override")
+	}
+}
+
+func TestLoadDepIndexDepmodDirs(t *testing.T) {
+	root := writeModTree(t, map[string]string{
+		"lib/search.conf": "search vendor built-in\n",
+		// overrides the file with the same name in lib
+		"etc/search.conf": "search updates built-in\n",
+		"lib/vendor.conf": "override wcn36xx 6.1.0 vendor\n",
+		// the kernel version is the name of the modules dir
+		"6.1.0/modules.dep": testDuplicateModuleDep,
+	})
+	config := &Config{DepmodDirs: []string{filepath.Join(root, "etc"), filepath.Join(root, "lib")}}
+
+	idx, err := config.LoadDepIndex(filepath.Join(root, "6.1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"wcn36xx": "vendor/wcn36xx.ko", "ath": "updates/dkms/ath.ko"} {
+		if path, _ := idx.Path(name); path != expected {
+			t.Errorf("%s: expected: %q, got: %q", name, expected, path)
+		}
+	}
+}
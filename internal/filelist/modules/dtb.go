@@ -0,0 +1,246 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+)
+
+// RunningDtb is the device tree blob that the running kernel was booted with
+var RunningDtb = "/sys/firmware/fdt"
+
+// DtbDirs are the directories that kernel packages install device tree blobs
+// to, in order of priority
+var DtbDirs = []string{
+	"/boot/dtbs",
+	"/usr/share/dtb",
+}
+
+// FindDtb returns the path of the device tree blob with the given name, e.g.
+// "qcom/msm8916-samsung-a5u-eur", in DtbDirs. The ".dtb" extension is
+// optional.
+func FindDtb(name string) (string, error) {
+	if !strings.HasSuffix(name, ".dtb") {
+		name += ".dtb"
+	}
+	for _, dir := range DtbDirs {
+		path := filepath.Join(dir, name)
+		exists, err := misc.Exists(path)
+		if err != nil {
+			return "", fmt.Errorf("received unexpected error when getting status for %q: %w", path, err)
+		}
+		if exists {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find device tree blob %q in %q", name, DtbDirs)
+}
+
+// dtbModules returns the modules for the devices in the given device tree
+// blobs, along with their dependencies. Modules that are blacklisted in
+// modprobe.d are skipped.
+func dtbModules(config *Config, dtbs []string, modDir string) (*filelist.FileList, error) {
+	idx, err := config.LoadDepIndex(modDir)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := config.loadAliasIndex(modDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, dtb := range dtbs {
+		data, err := os.ReadFile(dtb)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read device tree blob: %w", err)
+		}
+		modaliases, err := dtbModaliases(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse device tree blob %q: %w", dtb, err)
+		}
+		for _, modalias := range modaliases {
+			for _, name := range aliases.match(modalias) {
+				names[name] = true
+			}
+		}
+	}
+
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	files := filelist.NewFileList()
+	for _, name := range sorted {
+		if idx.Blacklisted(name) {
+			log.Printf("-- Skipping module blacklisted in modprobe.d: %q", name)
+			continue
+		}
+		log.Printf("-- Including module for the device tree: %q", name)
+		deps, err := getModule(config, name, modDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get module file %q: %w", name, err)
+		}
+		for _, dep := range deps {
+			files.Add(dep, dep)
+		}
+	}
+
+	return files, nil
+}
+
+// dtbModaliases returns the modalias of every enabled node in the given
+// flattened device tree blob that has a "compatible" property, in the format
+// the kernel uses for devices created from the device tree, e.g.
+// "of:NmmcT(null)Cqcom,sdhci-msm-v4Cqcom,sdhci-msm"
+func dtbModaliases(data []byte) ([]string, error) {
+	nodes, err := parseFdt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var modaliases []string
+	for _, node := range nodes {
+		compatible, found := node.props["compatible"]
+		if !found {
+			continue
+		}
+		switch node.stringProp("status") {
+		case "", "okay", "ok":
+		default:
+			// e.g. "disabled"
+			continue
+		}
+
+		name, _, _ := strings.Cut(node.name, "@")
+		deviceType := node.stringProp("device_type")
+		if deviceType == "" {
+			deviceType = "(null)"
+		}
+		modalias := "of:N" + name + "T" + deviceType
+		for _, c := range bytes.Split(bytes.TrimRight(compatible, "\x00"), []byte{0}) {
+			modalias += "C" + strings.ReplaceAll(string(c), " ", "_")
+		}
+		modaliases = append(modaliases, modalias)
+	}
+
+	return modaliases, nil
+}
+
+const (
+	fdtMagic     = 0xd00dfeed
+	fdtBeginNode = 0x1
+	fdtEndNode   = 0x2
+	fdtProp      = 0x3
+	fdtNop       = 0x4
+	fdtEnd       = 0x9
+)
+
+// fdtNode is a node in a flattened device tree
+type fdtNode struct {
+	// name of the node, including the unit address, e.g. "mmc@7824000"
+	name  string
+	props map[string][]byte
+}
+
+// stringProp returns the value of the given property as a string, without
+// the NUL terminator
+func (n fdtNode) stringProp(name string) string {
+	return string(bytes.TrimRight(n.props[name], "\x00"))
+}
+
+// parseFdt returns every node in the given flattened device tree blob, in the
+// order they appear in it. See the devicetree specification, chapter 5.
+func parseFdt(data []byte) ([]fdtNode, error) {
+	if len(data) < 40 {
+		return nil, fmt.Errorf("too short for a device tree header")
+	}
+	be := binary.BigEndian
+	if be.Uint32(data[0:]) != fdtMagic {
+		return nil, fmt.Errorf("invalid device tree magic: %#x", be.Uint32(data[0:]))
+	}
+	totalSize := be.Uint32(data[4:])
+	structOff := be.Uint32(data[8:])
+	stringsOff := be.Uint32(data[12:])
+	stringsSize := be.Uint32(data[32:])
+	structSize := be.Uint32(data[36:])
+	if uint64(totalSize) > uint64(len(data)) ||
+		uint64(structOff)+uint64(structSize) > uint64(totalSize) ||
+		uint64(stringsOff)+uint64(stringsSize) > uint64(totalSize) {
+		return nil, fmt.Errorf("invalid device tree header")
+	}
+	structBlock := data[structOff : structOff+structSize]
+	stringsBlock := data[stringsOff : stringsOff+stringsSize]
+
+	var nodes []fdtNode
+	// indexes in nodes of the nodes that haven't ended yet
+	var open []int
+	for off := 0; ; {
+		if off+4 > len(structBlock) {
+			return nil, fmt.Errorf("unexpected end of structure block")
+		}
+		token := be.Uint32(structBlock[off:])
+		off += 4
+
+		switch token {
+		case fdtBeginNode:
+			end := bytes.IndexByte(structBlock[off:], 0)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated node name at offset %d", off)
+			}
+			nodes = append(nodes, fdtNode{
+				name:  string(structBlock[off : off+end]),
+				props: make(map[string][]byte),
+			})
+			open = append(open, len(nodes)-1)
+			off = align4(off + end + 1)
+		case fdtEndNode:
+			if len(open) == 0 {
+				return nil, fmt.Errorf("unexpected end of node at offset %d", off)
+			}
+			open = open[:len(open)-1]
+		case fdtProp:
+			if off+8 > len(structBlock) {
+				return nil, fmt.Errorf("unexpected end of structure block")
+			}
+			length := int(be.Uint32(structBlock[off:]))
+			nameOff := int(be.Uint32(structBlock[off+4:]))
+			off += 8
+			if len(open) == 0 || off+length > len(structBlock) || nameOff >= len(stringsBlock) {
+				return nil, fmt.Errorf("invalid property at offset %d", off)
+			}
+			nameEnd := bytes.IndexByte(stringsBlock[nameOff:], 0)
+			if nameEnd < 0 {
+				return nil, fmt.Errorf("unterminated property name at offset %d", nameOff)
+			}
+			name := string(stringsBlock[nameOff : nameOff+nameEnd])
+			nodes[open[len(open)-1]].props[name] = structBlock[off : off+length]
+			off = align4(off + length)
+		case fdtNop:
+		case fdtEnd:
+			if len(open) != 0 {
+				return nil, fmt.Errorf("unexpected end of device tree, %d nodes not ended", len(open))
+			}
+			return nodes, nil
+		default:
+			return nil, fmt.Errorf("invalid token %#x at offset %d", token, off-4)
+		}
+	}
+}
+
+func align4(off int) int {
+	return (off + 3) &^ 3
+}
@@ -0,0 +1,177 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testDtbNode is a node for fakeDtb. Property values are stored as-is, so
+// strings need a NUL terminator.
+type testDtbNode struct {
+	name     string
+	props    [][2]string
+	children []testDtbNode
+}
+
+// fakeDtb returns a flattened device tree blob with the given root node
+func fakeDtb(t *testing.T, root testDtbNode) []byte {
+	t.Helper()
+
+	var structBlock, stringsBlock bytes.Buffer
+	stringOffs := make(map[string]int)
+	be := binary.BigEndian
+	pad := func() {
+		for structBlock.Len()%4 != 0 {
+			structBlock.WriteByte(0)
+		}
+	}
+	var writeNode func(n testDtbNode)
+	writeNode = func(n testDtbNode) {
+		binary.Write(&structBlock, be, uint32(fdtBeginNode))
+		structBlock.WriteString(n.name + "\x00")
+		pad()
+		for _, prop := range n.props {
+			off, found := stringOffs[prop[0]]
+			if !found {
+				off = stringsBlock.Len()
+				stringOffs[prop[0]] = off
+				stringsBlock.WriteString(prop[0] + "\x00")
+			}
+			binary.Write(&structBlock, be, uint32(fdtProp))
+			binary.Write(&structBlock, be, uint32(len(prop[1])))
+			binary.Write(&structBlock, be, uint32(off))
+			structBlock.WriteString(prop[1])
+			pad()
+		}
+		for _, child := range n.children {
+			writeNode(child)
+		}
+		binary.Write(&structBlock, be, uint32(fdtEndNode))
+	}
+	writeNode(root)
+	binary.Write(&structBlock, be, uint32(fdtEnd))
+
+	// header, followed by an empty memory reservation block
+	const headerSize = 40
+	const rsvmapSize = 16
+	structOff := headerSize + rsvmapSize
+	stringsOff := structOff + structBlock.Len()
+	totalSize := stringsOff + stringsBlock.Len()
+
+	var buf bytes.Buffer
+	for _, v := range []uint32{
+		fdtMagic,
+		uint32(totalSize),
+		uint32(structOff),
+		uint32(stringsOff),
+		headerSize,
+		17, // version
+		16, // last compatible version
+		0,  // boot CPU
+		uint32(stringsBlock.Len()),
+		uint32(structBlock.Len()),
+	} {
+		binary.Write(&buf, be, v)
+	}
+	buf.Write(make([]byte, rsvmapSize))
+	buf.Write(structBlock.Bytes())
+	buf.Write(stringsBlock.Bytes())
+	return buf.Bytes()
+}
+
+var testDtb = testDtbNode{
+	props: [][2]string{
+		{"compatible", "samsung,a5u-eur\x00qcom,msm8916\x00"},
+		{"#address-cells", "\x00\x00\x00\x02"},
+	},
+	children: []testDtbNode{
+		{name: "soc@0", props: [][2]string{{"compatible", "simple-bus\x00"}}, children: []testDtbNode{
+			{name: "mmc@7824900", props: [][2]string{
+				{"compatible", "qcom,msm8916-sdhci\x00qcom,sdhci-msm-v4\x00"},
+				{"status", "okay\x00"},
+			}},
+			{name: "usb@78d9000", props: [][2]string{
+				{"compatible", "qcom,ci-hdrc\x00"},
+				{"status", "disabled\x00"},
+			}},
+			{name: "cpu@0", props: [][2]string{
+				{"compatible", "arm,cortex-a53\x00"},
+				{"device_type", "cpu\x00"},
+			}},
+			{name: "no-compatible"},
+		}},
+	},
+}
+
+func TestDtbModaliases(t *testing.T) {
+	modaliases, err := dtbModaliases(fakeDtb(t, testDtb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"of:NT(null)Csamsung,a5u-eurCqcom,msm8916",
+		"of:NsocT(null)Csimple-bus",
+		"of:NmmcT(null)Cqcom,msm8916-sdhciCqcom,sdhci-msm-v4",
+		"of:NcpuTcpuCarm,cortex-a53",
+	}
+	if !reflect.DeepEqual(modaliases, expected) {
+		t.Errorf("expected: %q, got: %q", expected, modaliases)
+	}
+}
+
+func TestParseFdtInvalid(t *testing.T) {
+	valid := fakeDtb(t, testDtb)
+	tables := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte{0, 0, 0, 0}, valid[4:]...)},
+		{"truncated", valid[:len(valid)-20]},
+	}
+	for _, table := range tables {
+		if _, err := parseFdt(table.data); err == nil {
+			t.Errorf("%s: expected error", table.name)
+		}
+	}
+}
+
+func TestDtbModules(t *testing.T) {
+	files := modDirFiles(t, `kernel/drivers/mmc/host/sdhci-msm.ko: kernel/drivers/mmc/host/sdhci-pltfm.ko
+kernel/drivers/mmc/host/sdhci-pltfm.ko:
+kernel/drivers/usb/chipidea/ci_hdrc_msm.ko:
+`)
+	files["modules.alias"] = `alias of:N*T*Cqcom,sdhci-msm-v4C* sdhci_msm
+alias of:N*T*Cqcom,sdhci-msm-v4 sdhci_msm
+alias of:N*T*Cqcom,ci-hdrcC* ci_hdrc_msm
+alias of:N*T*Cqcom,ci-hdrc ci_hdrc_msm
+`
+	modDir := writeModTree(t, files)
+	dtb := filepath.Join(writeModTree(t, map[string]string{"test.dtb": string(fakeDtb(t, testDtb))}), "test.dtb")
+
+	out, err := dtbModules(&Config{}, []string{dtb}, modDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for f := range out.IterItems() {
+		rel, _ := filepath.Rel(modDir, f.Source)
+		got = append(got, rel)
+	}
+	sort.Strings(got)
+	// the usb node is disabled
+	expected := []string{
+		"kernel/drivers/mmc/host/sdhci-msm.ko",
+		"kernel/drivers/mmc/host/sdhci-pltfm.ko",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %q, got: %q", expected, got)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+)
+
+// firmwareSearchPath returns the directories in the given firmware dir that
+// the kernel searches for firmware in, in order
+func firmwareSearchPath(firmwareDir string, kernVer string) []string {
+	if firmwareDir == "" {
+		return nil
+	}
+	return []string{
+		filepath.Join(firmwareDir, "updates", kernVer),
+		filepath.Join(firmwareDir, "updates"),
+		filepath.Join(firmwareDir, kernVer),
+		firmwareDir,
+	}
+}
+
+// findFirmware returns the path of the given firmware file in the search path,
+// which may be compressed, or an empty string if it wasn't found.
+func findFirmware(name string, searchPath []string) (string, error) {
+	for _, dir := range searchPath {
+		path := filepath.Join(dir, name)
+		for _, ext := range []string{"", misc.ExtZstd, misc.ExtXz} {
+			exists, err := misc.Exists(path + ext)
+			if err != nil {
+				return "", fmt.Errorf("received unexpected error when getting status for %q: %w", path+ext, err)
+			}
+			if exists {
+				return path + ext, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// getModulesFirmware returns the firmware files that are listed in the
+// modinfo of the given modules, and that exist in the firmware search path
+// for the kernel in the firmware dir of the config. Missing firmware is
+// logged, since modules often list firmware for hardware variants that aren't
+// needed.
+func getModulesFirmware(config *Config, modules []string, kernVer string) (*filelist.FileList, error) {
+	files := filelist.NewFileList()
+	searchPath := firmwareSearchPath(config.FirmwareDir, kernVer)
+
+	for _, module := range modules {
+		info, err := config.loadModinfo(module)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read modinfo for %q: %w", module, err)
+		}
+		for _, name := range info["firmware"] {
+			path, err := findFirmware(name, searchPath)
+			if err != nil {
+				return nil, err
+			}
+			if path == "" {
+				log.Printf("-- Warning: firmware %q for module %q not found", name, moduleName(module))
+				continue
+			}
+			files.Add(path, path)
+		}
+	}
+
+	return files, nil
+}
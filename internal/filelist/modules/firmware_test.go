@@ -0,0 +1,69 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+)
+
+func TestGetModulesFirmware(t *testing.T) {
+	files := make(map[string]string)
+	for _, file := range []string{
+		"firmware/qcom/a300_pm4.fw",
+		"firmware/qcom/a300_pfp.fw",
+		"firmware/updates/6.1.0/qcom/a300_pfp.fw",
+		"firmware/qcom/venus.mbn.zst",
+		"firmware/rtl_bt/rtl8723b_fw.bin.xz",
+	} {
+		files[file] = "firmware"
+	}
+
+	modules := map[string][]string{
+		"msm.ko":      {"firmware=qcom/a300_pm4.fw", "firmware=qcom/a300_pfp.fw", "firmware=qcom/missing.fw"},
+		"venus.ko":    {"firmware=qcom/venus.mbn"},
+		"btrtl.ko.gz": {"firmware=rtl_bt/rtl8723b_fw.bin", "license=GPL"},
+		"nofw.ko":     {"license=GPL"},
+	}
+	for name, modinfo := range modules {
+		data := fakeModule(t, modinfo)
+		if ext := misc.CompressionExt(name); ext != "" {
+			var err error
+			if data, err = misc.Compress(ext, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files[name] = string(data)
+	}
+	root := writeModTree(t, files)
+	var modPaths []string
+	for name := range modules {
+		modPaths = append(modPaths, filepath.Join(root, name))
+	}
+
+	config := &Config{FirmwareDir: filepath.Join(root, "firmware")}
+	firmware, err := getModulesFirmware(config, modPaths, "6.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for f := range firmware.IterItems() {
+		rel, _ := filepath.Rel(root, f.Source)
+		got = append(got, rel)
+	}
+	sort.Strings(got)
+	expected := []string{
+		"firmware/qcom/a300_pm4.fw",
+		"firmware/qcom/venus.mbn.zst",
+		"firmware/rtl_bt/rtl8723b_fw.bin.xz",
+		"firmware/updates/6.1.0/qcom/a300_pfp.fw",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: %q, got: %q", expected, got)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadHostModules returns the names of the modules that are needed by the
+// hardware in the given sysfs tree, and the modules that are currently loaded
+// according to procModules (e.g. /proc/modules). Device modaliases are matched
+// against modules.alias in modDir. The result is only computed once for each
+// combination of arguments.
+func (c *Config) LoadHostModules(sysfsRoot string, procModules string, modDir string) (map[string]bool, error) {
+	c.hostModulesMu.Lock()
+	defer c.hostModulesMu.Unlock()
+
+	key := strings.Join([]string{sysfsRoot, procModules, modDir}, "\x00")
+	if modules, found := c.hostModules[key]; found {
+		return modules, nil
+	}
+
+	aliases, err := c.loadAliasIndex(modDir)
+	if err != nil {
+		return nil, err
+	}
+
+	modaliases, err := readModaliases(sysfsRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	modules := make(map[string]bool)
+	for _, modalias := range modaliases {
+		for _, name := range aliases.match(modalias) {
+			modules[name] = true
+		}
+	}
+
+	if procModules != "" {
+		loaded, err := readProcModules(procModules)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range loaded {
+			modules[name] = true
+		}
+	}
+
+	if c.hostModules == nil {
+		c.hostModules = make(map[string]map[string]bool)
+	}
+	c.hostModules[key] = modules
+	return modules, nil
+}
+
+// loadAliasIndex returns the aliasIndex for modules.alias in the given modules
+// dir. The file is only parsed once for each dir.
+func (c *Config) loadAliasIndex(modDir string) (*aliasIndex, error) {
+	c.aliasIndexesMu.Lock()
+	defer c.aliasIndexesMu.Unlock()
+
+	if idx, found := c.aliasIndexes[modDir]; found {
+		return idx, nil
+	}
+
+	aliasPath := filepath.Join(modDir, "modules.alias")
+	fd, err := os.Open(aliasPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open modules.alias: %w", err)
+	}
+	defer fd.Close()
+	idx, err := parseModulesAlias(fd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q: %w", aliasPath, err)
+	}
+
+	if c.aliasIndexes == nil {
+		c.aliasIndexes = make(map[string]*aliasIndex)
+	}
+	c.aliasIndexes[modDir] = idx
+	return idx, nil
+}
+
+// readModaliases returns the contents of every modalias file for devices in
+// the given sysfs tree
+func readModaliases(sysfsRoot string) ([]string, error) {
+	var modaliases []string
+	devices := filepath.Join(sysfsRoot, "devices")
+	// symlinks aren't followed, everything in /sys/devices is reachable
+	// without them
+	err := filepath.WalkDir(devices, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != devices && os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Name() != "modalias" || !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// some attributes can't be read, e.g. if the device went away
+			return nil
+		}
+		if modalias := strings.TrimSpace(string(data)); modalias != "" {
+			modaliases = append(modaliases, modalias)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read modaliases from %q: %w", devices, err)
+	}
+
+	return modaliases, nil
+}
+
+// readProcModules returns the names of the loaded modules listed in the given
+// file, in the format of /proc/modules
+func readProcModules(path string) ([]string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %q: %w", path, err)
+	}
+	defer fd.Close()
+
+	var modules []string
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 {
+			modules = append(modules, moduleName(fields[0]))
+		}
+	}
+
+	return modules, s.Err()
+}
+
+// aliasIndex is the contents of a modules.alias file
+type aliasIndex struct {
+	// alias patterns, grouped by the prefix before the first ":" to avoid
+	// matching every modalias against every pattern
+	patterns map[string][]aliasPattern
+}
+
+type aliasPattern struct {
+	pattern string
+	module  string
+}
+
+func parseModulesAlias(r io.Reader) (*aliasIndex, error) {
+	idx := &aliasIndex{
+		patterns: make(map[string][]aliasPattern),
+	}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "alias" || len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line: %q", s.Text())
+		}
+		idx.add(fields[1], fields[2])
+	}
+
+	return idx, s.Err()
+}
+
+// add adds an alias pattern for the given module
+func (idx *aliasIndex) add(pattern string, module string) {
+	prefix := aliasPrefix(pattern)
+	idx.patterns[prefix] = append(idx.patterns[prefix], aliasPattern{
+		pattern: pattern,
+		module:  moduleName(module),
+	})
+}
+
+// match returns the names of the modules with an alias that matches the given
+// modalias
+func (idx *aliasIndex) match(modalias string) (modules []string) {
+	candidates := idx.patterns[""]
+	if prefix := aliasPrefix(modalias); prefix != "" {
+		candidates = append(candidates[:len(candidates):len(candidates)], idx.patterns[prefix]...)
+	}
+	for _, p := range candidates {
+		if fnmatch(p.pattern, modalias) {
+			modules = append(modules, p.module)
+		}
+	}
+	return
+}
+
+func aliasPrefix(alias string) string {
+	prefix, _, found := strings.Cut(alias, ":")
+	if !found || strings.ContainsAny(prefix, "*?[") {
+		return ""
+	}
+	return prefix
+}
+
+// fnmatch reports whether name matches the shell pattern, like fnmatch(3)
+// with no flags, which is what kmod uses for matching aliases. Unlike
+// filepath.Match, "*" also matches "/".
+func fnmatch(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if fnmatch(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		case '[':
+			if len(name) == 0 {
+				return false
+			}
+			matched, rest, ok := matchClass(pattern, name[0])
+			if !ok {
+				// not a valid class, so "[" is matched literally
+				if name[0] != '[' {
+					return false
+				}
+				break
+			}
+			if !matched {
+				return false
+			}
+			pattern = rest
+			name = name[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchClass matches c against the bracket expression at the start of
+// pattern, and returns the rest of the pattern after it. ok is false if the
+// pattern doesn't start with a valid bracket expression.
+func matchClass(pattern string, c byte) (matched bool, rest string, ok bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+	for first := true; i < len(pattern); first = false {
+		if pattern[i] == ']' && !first {
+			return matched != negate, pattern[i+1:], true
+		}
+		lo := pattern[i]
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, "", false
+}
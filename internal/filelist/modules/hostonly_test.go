@@ -0,0 +1,169 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFnmatch(t *testing.T) {
+	tables := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "foobar", false},
+		{"foo*", "foobar", true},
+		{"*", "", true},
+		{"f?o", "foo", true},
+		{"f?o", "fo", false},
+		{"of:N*T*Cqcom,sdhci-msm-v4C*", "of:NsdhciT(null)Cqcom,sdhci-msm-v4Cqcom,sdhci-msm-v5", true},
+		{"of:N*T*Cqcom,sdhci-msm-v4", "of:NsdhciT(null)Cqcom,sdhci-msm-v5", false},
+		{"pci:v00008086d*sv*sd*bc*sc*i*", "pci:v00008086d00001234sv00000000sd00000000bc06sc04i00", true},
+		{"pci:v00008086d*sv*sd*bc*sc*i*", "pci:v000010DEd00001234sv00000000sd00000000bc06sc04i00", false},
+		{"usb:v*p*d*dc*dsc*dp*ic08isc06ip50in*", "usb:v0781p5567d0100dc00dsc00dp00ic08isc06ip50in00", true},
+		{"a*/b", "a/x/b", true},
+		{"[a-c]x", "bx", true},
+		{"[a-c]x", "dx", false},
+		{"[!a-c]x", "dx", true},
+		{"[^a-c]x", "ax", false},
+		{"[]]x", "]x", true},
+		{"[x", "[x", true},
+		{"\\*x", "*x", true},
+		{"\\*x", "ax", false},
+	}
+	for _, table := range tables {
+		if out := fnmatch(table.pattern, table.name); out != table.expected {
+			t.Errorf("fnmatch(%q, %q): expected %t, got %t", table.pattern, table.name, table.expected, out)
+		}
+	}
+}
+
+func TestLoadHostModules(t *testing.T) {
+	root := writeModTree(t, map[string]string{
+		"sys/devices/platform/soc/7824900.mmc/modalias":       "of:NsdhciT(null)Cqcom,sdhci-msm-v4\n",
+		"sys/devices/platform/soc/78d9000.usb/modalias":       "of:NusbT(null)Cqcom,ci-hdrc\n",
+		"sys/devices/platform/soc/78d9000.usb/usb1/modalias":  "usb:v0781p5567d0100dc00dsc00dp00ic08isc06ip50in00\n",
+		"sys/devices/virtual/empty/modalias":                  "\n",
+		"sys/devices/platform/soc/unmatched/modalias":         "platform:nothing-here\n",
+		"sys/devices/platform/soc/7824900.mmc/not_a_modalias": "of:NfooT(null)Cfoo,bar\n",
+		"proc_modules": `loaded_mod 16384 0 - Live 0x0000000000000000
+another-loaded 16384 1 loaded_mod, Live 0x0000000000000000
+`,
+		"modules/modules.alias": `# Aliases extracted from modules themselves.
+alias of:N*T*Cqcom,sdhci-msm-v4C* sdhci_msm
+alias of:N*T*Cqcom,sdhci-msm-v4 sdhci_msm
+alias of:N*T*Cqcom,ci-hdrc ci_hdrc_msm
+alias of:N*T*Cfoo,bar foo
+alias usb:v*p*d*dc*dsc*dp*ic08isc06ip50in* usb_storage
+alias usb:v*p*d*dc*dsc*dp*ic08isc06ip62in* uas
+alias pci:v*d*sv*sd*bc01sc08i02* nvme
+`,
+	})
+	sysfs := filepath.Join(root, "sys")
+	modDir := filepath.Join(root, "modules")
+	config := &Config{}
+	// symlinks in sysfs shouldn't be followed
+	if err := os.Symlink(filepath.Join(sysfs, "devices/platform"), filepath.Join(sysfs, "devices/platform/soc/loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	toSlice := func(m map[string]bool) (s []string) {
+		for k := range m {
+			s = append(s, k)
+		}
+		sort.Strings(s)
+		return
+	}
+
+	modules, err := config.LoadHostModules(sysfs, "", modDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"ci_hdrc_msm", "sdhci_msm", "usb_storage"}
+	if out := toSlice(modules); !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+
+	modules, err = config.LoadHostModules(sysfs, filepath.Join(root, "proc_modules"), modDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"another_loaded", "ci_hdrc_msm", "loaded_mod", "sdhci_msm", "usb_storage"}
+	if out := toSlice(modules); !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+
+	if _, err := config.LoadHostModules(filepath.Join(root, "missing"), "", modDir); err == nil {
+		t.Errorf("expected error for missing sysfs")
+	}
+
+	// modules.alias is only read once for each Config
+	if err := os.WriteFile(filepath.Join(modDir, "modules.alias"), []byte("alias of:N*T*Cqcom,ci-hdrc ci_hdrc_msm\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if modules, err = config.LoadHostModules(sysfs, "", modDir); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"ci_hdrc_msm", "sdhci_msm", "usb_storage"}
+	if out := toSlice(modules); !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected cached: %q, got: %q", expected, out)
+	}
+	if modules, err = (&Config{}).LoadHostModules(sysfs, "", modDir); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"ci_hdrc_msm"}
+	if out := toSlice(modules); !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+func TestSlurpModulesHostOnly(t *testing.T) {
+	modDir := writeModTree(t, modDirFiles(t, `kernel/drivers/mmc/host/sdhci-msm.ko: kernel/drivers/mmc/host/sdhci-pltfm.ko
+kernel/drivers/mmc/host/sdhci-pltfm.ko:
+kernel/drivers/mmc/host/dw_mmc.ko:
+kernel/drivers/usb/storage/usb-storage.ko:
+`))
+
+	list := "kernel/drivers/mmc/\nusb-storage\n"
+	hostModules := map[string]bool{"sdhci_msm": true}
+
+	tables := []struct {
+		hostModules map[string]bool
+		expected    []string
+	}{
+		{nil, []string{
+			"kernel/drivers/mmc/host/dw_mmc.ko",
+			"kernel/drivers/mmc/host/sdhci-msm.ko",
+			"kernel/drivers/mmc/host/sdhci-pltfm.ko",
+			"kernel/drivers/usb/storage/usb-storage.ko",
+		}},
+		{hostModules, []string{
+			"kernel/drivers/mmc/host/sdhci-msm.ko",
+			"kernel/drivers/mmc/host/sdhci-pltfm.ko",
+			"kernel/drivers/usb/storage/usb-storage.ko",
+		}},
+	}
+	for _, table := range tables {
+		out, err := slurpModules(&Config{}, strings.NewReader(list), modDir, table.hostModules, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for f := range out.IterItems() {
+			rel, _ := filepath.Rel(modDir, f.Source)
+			got = append(got, rel)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("expected: %q, got: %q", table.expected, got)
+		}
+	}
+}
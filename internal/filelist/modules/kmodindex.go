@@ -0,0 +1,167 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Constants for the kmod index (modules.*.bin) file format, as written by
+// depmod.
+const (
+	kmodIndexMagic    = 0xB007F457
+	kmodIndexVersion  = 0x00020001
+	kmodIndexChildMax = 128
+
+	kmodNodePrefix = 0x80000000
+	kmodNodeValues = 0x40000000
+	kmodNodeChilds = 0x20000000
+)
+
+type kmodIndexValue struct {
+	value    string
+	priority uint32
+}
+
+// kmodIndex is a trie that can be written out in the format used by the
+// modules.*.bin files that kmod/modprobe read.
+type kmodIndex struct {
+	prefix   string
+	children map[byte]*kmodIndex
+	values   []kmodIndexValue
+}
+
+func newKmodIndex() *kmodIndex {
+	return &kmodIndex{
+		children: make(map[byte]*kmodIndex),
+	}
+}
+
+// insert adds the given key/value to the index. Values for the same key are
+// kept sorted by priority, duplicate values are ignored.
+func (n *kmodIndex) insert(key string, value string, priority uint32) error {
+	for i := 0; i < len(key); i++ {
+		if key[i] >= kmodIndexChildMax {
+			return fmt.Errorf("invalid character in index key: %q", key)
+		}
+	}
+
+	for {
+		// make sure the node prefix is a prefix of the key, splitting the
+		// node if necessary
+		j := 0
+		for ; j < len(n.prefix); j++ {
+			if j >= len(key) || n.prefix[j] != key[j] {
+				child := &kmodIndex{
+					prefix:   n.prefix[j+1:],
+					children: n.children,
+					values:   n.values,
+				}
+				ch := n.prefix[j]
+				n.prefix = n.prefix[:j]
+				n.children = map[byte]*kmodIndex{ch: child}
+				n.values = nil
+				break
+			}
+		}
+		key = key[j:]
+
+		if len(key) == 0 {
+			n.addValue(value, priority)
+			return nil
+		}
+
+		ch := key[0]
+		child, found := n.children[ch]
+		if !found {
+			child = newKmodIndex()
+			child.prefix = key[1:]
+			child.addValue(value, priority)
+			n.children[ch] = child
+			return nil
+		}
+
+		n = child
+		key = key[1:]
+	}
+}
+
+func (n *kmodIndex) addValue(value string, priority uint32) {
+	for _, v := range n.values {
+		if v.value == value {
+			return
+		}
+	}
+	i := 0
+	for i < len(n.values) && n.values[i].priority <= priority {
+		i++
+	}
+	n.values = append(n.values, kmodIndexValue{})
+	copy(n.values[i+1:], n.values[i:])
+	n.values[i] = kmodIndexValue{value: value, priority: priority}
+}
+
+// Bytes returns the index in the kmod binary index format
+func (n *kmodIndex) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(kmodIndexMagic))
+	binary.Write(buf, binary.BigEndian, uint32(kmodIndexVersion))
+	// offset to the root node is filled in after writing the trie
+	binary.Write(buf, binary.BigEndian, uint32(0))
+
+	root := n.write(buf)
+	out := buf.Bytes()
+	binary.BigEndian.PutUint32(out[8:], root)
+
+	return out
+}
+
+// write writes the node and its children to buf, children first, and returns
+// the offset of the node combined with flags for what the node contains.
+func (n *kmodIndex) write(buf *bytes.Buffer) uint32 {
+	var first, last byte = kmodIndexChildMax, 0
+	for ch := range n.children {
+		first = min(first, ch)
+		last = max(last, ch)
+	}
+
+	var childOffsets []uint32
+	if len(n.children) > 0 {
+		childOffsets = make([]uint32, int(last)-int(first)+1)
+		for ch := int(first); ch <= int(last); ch++ {
+			if child, found := n.children[byte(ch)]; found {
+				childOffsets[ch-int(first)] = child.write(buf)
+			}
+		}
+	}
+
+	offset := uint32(buf.Len())
+
+	if len(n.prefix) > 0 {
+		buf.WriteString(n.prefix)
+		buf.WriteByte(0)
+		offset |= kmodNodePrefix
+	}
+
+	if len(childOffsets) > 0 {
+		buf.WriteByte(first)
+		buf.WriteByte(last)
+		binary.Write(buf, binary.BigEndian, childOffsets)
+		offset |= kmodNodeChilds
+	}
+
+	if len(n.values) > 0 {
+		binary.Write(buf, binary.BigEndian, uint32(len(n.values)))
+		for _, v := range n.values {
+			binary.Write(buf, binary.BigEndian, v.priority)
+			buf.WriteString(v.value)
+			buf.WriteByte(0)
+		}
+		offset |= kmodNodeValues
+	}
+
+	return offset
+}
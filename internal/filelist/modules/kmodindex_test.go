@@ -0,0 +1,122 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// kmodIndexLookup returns the values for the given key from an index in the
+// kmod binary format, following the same steps as libkmod's index lookup.
+func kmodIndexLookup(t *testing.T, data []byte, key string) []string {
+	t.Helper()
+
+	if binary.BigEndian.Uint32(data[0:]) != kmodIndexMagic {
+		t.Fatal("bad index magic")
+	}
+	if binary.BigEndian.Uint32(data[4:]) != kmodIndexVersion {
+		t.Fatal("bad index version")
+	}
+
+	offset := binary.BigEndian.Uint32(data[8:])
+	for {
+		pos := offset & 0x0FFFFFFF
+		if offset&kmodNodePrefix != 0 {
+			end := pos + uint32(bytes.IndexByte(data[pos:], 0))
+			prefix := string(data[pos:end])
+			pos = end + 1
+			if len(key) < len(prefix) || key[:len(prefix)] != prefix {
+				return nil
+			}
+			key = key[len(prefix):]
+		}
+
+		var first, last byte
+		var children []uint32
+		if offset&kmodNodeChilds != 0 {
+			first, last = data[pos], data[pos+1]
+			pos += 2
+			for i := 0; i <= int(last-first); i++ {
+				children = append(children, binary.BigEndian.Uint32(data[pos:]))
+				pos += 4
+			}
+		}
+
+		var values []string
+		if offset&kmodNodeValues != 0 {
+			count := binary.BigEndian.Uint32(data[pos:])
+			pos += 4
+			for i := uint32(0); i < count; i++ {
+				pos += 4 // priority
+				end := pos + uint32(bytes.IndexByte(data[pos:], 0))
+				values = append(values, string(data[pos:end]))
+				pos = end + 1
+			}
+		}
+
+		if len(key) == 0 {
+			return values
+		}
+		if children == nil || key[0] < first || key[0] > last {
+			return nil
+		}
+		offset = children[key[0]-first]
+		if offset == 0 {
+			return nil
+		}
+		key = key[1:]
+	}
+}
+
+func TestKmodIndex(t *testing.T) {
+	entries := []struct {
+		key      string
+		value    string
+		priority uint32
+	}{
+		{"snd_soc_core", "kernel/sound/soc/snd-soc-core.ko: kernel/sound/core/snd.ko", 3},
+		{"snd", "kernel/sound/core/snd.ko:", 1},
+		{"snd_soc_wcd9335", "kernel/sound/soc/codecs/snd-soc-wcd9335.ko:", 4},
+		{"dw_wdt", "kernel/drivers/watchdog/dw_wdt.ko.xz: kernel/drivers/watchdog/watchdog.ko.xz", 2},
+		{"pci:v00008086d*", "e1000e", 6},
+		{"pci:v00008086d*", "igb", 5},
+		// duplicate, should be ignored
+		{"pci:v00008086d*", "igb", 7},
+	}
+
+	idx := newKmodIndex()
+	for _, e := range entries {
+		if err := idx.insert(e.key, e.value, e.priority); err != nil {
+			t.Fatal("unexpected error: ", err)
+		}
+	}
+	data := idx.Bytes()
+
+	tables := []struct {
+		key      string
+		expected []string
+	}{
+		{"snd", []string{"kernel/sound/core/snd.ko:"}},
+		{"snd_soc_core", []string{"kernel/sound/soc/snd-soc-core.ko: kernel/sound/core/snd.ko"}},
+		{"snd_soc_wcd9335", []string{"kernel/sound/soc/codecs/snd-soc-wcd9335.ko:"}},
+		{"dw_wdt", []string{"kernel/drivers/watchdog/dw_wdt.ko.xz: kernel/drivers/watchdog/watchdog.ko.xz"}},
+		{"pci:v00008086d*", []string{"igb", "e1000e"}},
+		{"snd_soc", nil},
+		{"watchdog", nil},
+		{"", nil},
+	}
+	for _, table := range tables {
+		out := kmodIndexLookup(t, data, table.key)
+		if !reflect.DeepEqual(out, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.key, table.expected, out)
+		}
+	}
+
+	if err := idx.insert("snd\xff", "foo", 0); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GenerateLoadOrder returns a file with the order to load the kernel modules
+// in the given files in, for each modules dir that they are in. files is the
+// path of each file -> the list file that it came from, see
+// filelist.File.Origin. The returned map is the path of each generated file,
+// e.g. /lib/modules/<kernel version>/<name> -> contents.
+//
+// Modules are grouped by the list file they came from, ordered by the file
+// name of the list. Within each group modules are ordered like in
+// modules.order, and every module comes after the modules it depends on. Each
+// group starts with a "# <list file>" comment, followed by one module name per
+// line.
+func GenerateLoadOrder(config *Config, files map[string]string, name string) (map[string][]byte, error) {
+	// modules dir -> list file -> module names
+	modDirs := make(map[string]map[string][]string)
+	for file, origin := range files {
+		modDir, rel, found := splitModulesDir(file)
+		if !found || !isModule(rel) {
+			continue
+		}
+		if _, found := modDirs[modDir]; !found {
+			modDirs[modDir] = make(map[string][]string)
+		}
+		modDirs[modDir][origin] = append(modDirs[modDir][origin], moduleName(rel))
+	}
+
+	generated := make(map[string][]byte)
+	for modDir, groups := range modDirs {
+		out, err := loadOrder(config, modDir, groups)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate module load order for %q: %w", modDir, err)
+		}
+		generated[filepath.Join(modDir, name)] = out
+	}
+
+	return generated, nil
+}
+
+func loadOrder(config *Config, modDir string, groups map[string][]string) ([]byte, error) {
+	idx, err := config.LoadDepIndex(modDir)
+	if err != nil {
+		return nil, err
+	}
+	position, err := readModulesOrder(modDir)
+	if err != nil {
+		return nil, err
+	}
+
+	included := make(map[string]bool)
+	var origins []string
+	for origin, names := range groups {
+		origins = append(origins, origin)
+		for _, name := range names {
+			included[name] = true
+		}
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		a, b := filepath.Base(origins[i]), filepath.Base(origins[j])
+		if a != b {
+			return a < b
+		}
+		return origins[i] < origins[j]
+	})
+
+	var out bytes.Buffer
+	emitted := make(map[string]bool)
+	for _, origin := range origins {
+		names := groups[origin]
+		// modules that aren't in modules.order come last, by name
+		sort.Slice(names, func(i, j int) bool {
+			pi, foundI := position[names[i]]
+			pj, foundJ := position[names[j]]
+			if foundI != foundJ {
+				return foundI
+			}
+			if pi != pj {
+				return pi < pj
+			}
+			return names[i] < names[j]
+		})
+
+		var lines []string
+		var visit func(name string)
+		visit = func(name string) {
+			if emitted[name] || !included[name] {
+				return
+			}
+			emitted[name] = true
+			for _, dep := range idx.Deps(name) {
+				visit(dep)
+			}
+			lines = append(lines, name)
+		}
+		for _, name := range names {
+			visit(name)
+		}
+
+		if len(lines) > 0 {
+			fmt.Fprintf(&out, "# %s\n%s\n", origin, strings.Join(lines, "\n"))
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// readModulesOrder returns the position of each module in modules.order in
+// the given modules dir. If there's no modules.order, the map is empty.
+func readModulesOrder(modDir string) (map[string]int, error) {
+	position := make(map[string]int)
+	path := filepath.Join(modDir, "modules.order")
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return position, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if _, found := position[moduleName(line)]; !found {
+			position[moduleName(line)] = len(position)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %q: %w", path, err)
+	}
+
+	return position, nil
+}
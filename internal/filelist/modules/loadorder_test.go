@@ -0,0 +1,67 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateLoadOrder(t *testing.T) {
+	root := writeModTree(t, map[string]string{
+		"lib/modules/6.1.0/modules.dep": `kernel/drivers/mmc/host/sdhci-msm.ko.zst: kernel/drivers/mmc/host/sdhci-pltfm.ko.zst kernel/drivers/mmc/core/mmc_core.ko.zst
+kernel/drivers/mmc/host/sdhci-pltfm.ko.zst: kernel/drivers/mmc/core/mmc_core.ko.zst
+kernel/drivers/mmc/core/mmc_core.ko.zst:
+kernel/drivers/usb/storage/usb-storage.ko.zst: kernel/drivers/usb/storage/uas.ko.zst
+kernel/drivers/usb/storage/uas.ko.zst:
+kernel/fs/ext4/ext4.ko.zst:
+extra/vendor.ko:
+`,
+		"lib/modules/6.1.0/modules.order": `kernel/drivers/usb/storage/uas.ko
+kernel/drivers/usb/storage/usb-storage.ko
+kernel/fs/ext4/ext4.ko
+kernel/drivers/mmc/core/mmc_core.ko
+kernel/drivers/mmc/host/sdhci-pltfm.ko
+kernel/drivers/mmc/host/sdhci-msm.ko
+`,
+	})
+	modDir := filepath.Join(root, "lib/modules/6.1.0")
+
+	files := map[string]string{
+		"/bin/sh":                                                          "/usr/share/mkinitfs/files/00-base.files",
+		filepath.Join(modDir, "modules.builtin"):                           "",
+		filepath.Join(modDir, "extra/vendor.ko"):                           "/etc/mkinitfs/modules/00-vendor.modules",
+		filepath.Join(modDir, "kernel/fs/ext4/ext4.ko"):                    "/usr/share/mkinitfs/modules/10-fs.modules",
+		filepath.Join(modDir, "kernel/drivers/mmc/host/sdhci-msm.ko"):      "/usr/share/mkinitfs/modules/00-default.modules",
+		filepath.Join(modDir, "kernel/drivers/usb/storage/usb-storage.ko"): "/usr/share/mkinitfs/modules/00-default.modules",
+		// dependency that was listed in a later list
+		filepath.Join(modDir, "kernel/drivers/usb/storage/uas.ko"): "/usr/share/mkinitfs/modules/10-fs.modules",
+		// modules that another module depends on come before it
+		filepath.Join(modDir, "kernel/drivers/mmc/core/mmc_core.ko"):    "/usr/share/mkinitfs/modules/00-default.modules",
+		filepath.Join(modDir, "kernel/drivers/mmc/host/sdhci-pltfm.ko"): "/usr/share/mkinitfs/modules/00-default.modules",
+	}
+	generated, err := GenerateLoadOrder(&Config{}, files, "initfs.order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 1 {
+		t.Fatalf("expected 1 file, got: %q", generated)
+	}
+
+	expected := `# /usr/share/mkinitfs/modules/00-default.modules
+uas
+usb_storage
+mmc_core
+sdhci_pltfm
+sdhci_msm
+# /etc/mkinitfs/modules/00-vendor.modules
+vendor
+# /usr/share/mkinitfs/modules/10-fs.modules
+ext4
+`
+	got := string(generated[filepath.Join(modDir, "initfs.order")])
+	if got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
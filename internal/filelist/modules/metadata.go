@@ -0,0 +1,242 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// generatedMetadata are the modules.* files that are generated by
+// GenerateMetadata for the modules in an archive, instead of being copied from
+// the system.
+var generatedMetadata = map[string]bool{
+	"modules.dep":         true,
+	"modules.dep.bin":     true,
+	"modules.alias":       true,
+	"modules.alias.bin":   true,
+	"modules.softdep":     true,
+	"modules.symbols":     true,
+	"modules.symbols.bin": true,
+	"modules.devname":     true,
+}
+
+// GenerateMetadata returns the modules.* files that modprobe uses, for exactly
+// the kernel modules in the given list of files. The files are generated from
+// the ones on the system, leaving out every module that isn't in the list.
+// Files are grouped by the modules dir that they are in (e.g.
+// /lib/modules/<kernel version>), and a set of metadata is generated for each
+// dir. The returned map is the path for each generated file -> contents.
+//
+// Modules are matched by name, so the paths in the list can use a different
+// compression extension than the modules on the system, e.g. if they are
+// converted when added to an archive.
+func GenerateMetadata(files []string) (map[string][]byte, error) {
+	// modules dir -> module name -> path relative to the modules dir
+	modDirs := make(map[string]map[string]string)
+	for _, file := range files {
+		modDir, rel, found := splitModulesDir(file)
+		if !found {
+			continue
+		}
+		if _, found := modDirs[modDir]; !found {
+			modDirs[modDir] = make(map[string]string)
+		}
+		if isModule(rel) {
+			modDirs[modDir][moduleName(rel)] = rel
+		}
+	}
+
+	generated := make(map[string][]byte)
+	for modDir, modules := range modDirs {
+		m := &metadata{
+			modDir:  modDir,
+			modules: modules,
+		}
+		out, err := m.generate()
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate module metadata for %q: %w", modDir, err)
+		}
+		for name, data := range out {
+			generated[filepath.Join(modDir, name)] = data
+		}
+	}
+
+	return generated, nil
+}
+
+// splitModulesDir splits the given path into the modules dir that it is in,
+// e.g. /lib/modules/<kernel version>, and the path relative to it. found is
+// false if the path isn't in a modules dir.
+func splitModulesDir(path string) (modDir string, rel string, found bool) {
+	i := strings.Index(path, "/lib/modules/")
+	if i < 0 {
+		return "", "", false
+	}
+	kernVer, rel, found := strings.Cut(path[i+len("/lib/modules/"):], "/")
+	if !found {
+		return "", "", false
+	}
+	return path[:i+len("/lib/modules/")] + kernVer, rel, true
+}
+
+type metadata struct {
+	// modules dir on the system
+	modDir string
+	// module name -> path relative to modDir, for the modules to include
+	modules map[string]string
+}
+
+func (m *metadata) generate() (map[string][]byte, error) {
+	out := make(map[string][]byte)
+
+	var err error
+	if out["modules.dep"], err = m.filter("modules.dep", m.depLine); err != nil {
+		return nil, err
+	}
+	if out["modules.dep.bin"], err = modulesDepIndex(out["modules.dep"]); err != nil {
+		return nil, err
+	}
+
+	// lines are "alias <pattern> <module>", also for modules.symbols
+	for _, name := range []string{"modules.alias", "modules.symbols"} {
+		if out[name], err = m.filter(name, m.aliasLine); err != nil {
+			return nil, err
+		}
+		if out[name+".bin"], err = modulesAliasIndex(out[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	if out["modules.softdep"], err = m.filter("modules.softdep", m.softdepLine); err != nil {
+		return nil, err
+	}
+
+	// lines are "<module> <devname> <type><major>:<minor>"
+	if out["modules.devname"], err = m.filter("modules.devname", func(fields []string) (string, bool) {
+		return strings.Join(fields, " "), len(fields) > 0 && m.included(fields[0])
+	}); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (m *metadata) included(name string) bool {
+	_, found := m.modules[moduleName(name)]
+	return found
+}
+
+// filter reads the given file from the modules dir, and calls line for every
+// line in it that isn't a comment. line returns the new line, and false if
+// the line should be left out. Comments are kept. Files that don't exist are
+// treated as empty.
+func (m *metadata) filter(name string, line func(fields []string) (string, bool)) ([]byte, error) {
+	path := filepath.Join(m.modDir, name)
+	var out bytes.Buffer
+
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return out.Bytes(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	s := bufio.NewScanner(fd)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		text := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(text, "#") {
+			out.WriteString(text + "\n")
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if l, keep := line(fields); keep {
+			out.WriteString(l + "\n")
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %q: %w", path, err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// depLine returns a modules.dep line using the module paths in m.modules.
+// Dependencies that aren't included are left out.
+func (m *metadata) depLine(fields []string) (string, bool) {
+	name := moduleName(strings.TrimSuffix(fields[0], ":"))
+	path, found := m.modules[name]
+	if !found {
+		return "", false
+	}
+
+	line := path + ":"
+	for _, dep := range fields[1:] {
+		depPath, found := m.modules[moduleName(dep)]
+		if !found {
+			log.Printf("-- Warning: module %q depends on %q, which isn't included", name, moduleName(dep))
+			continue
+		}
+		line += " " + depPath
+	}
+
+	return line, true
+}
+
+// aliasLine keeps lines in modules.alias and modules.symbols for included
+// modules
+func (m *metadata) aliasLine(fields []string) (string, bool) {
+	if len(fields) != 3 || fields[0] != "alias" {
+		return "", false
+	}
+	return strings.Join(fields, " "), m.included(fields[2])
+}
+
+// softdepLine keeps lines in modules.softdep for included modules
+func (m *metadata) softdepLine(fields []string) (string, bool) {
+	if len(fields) < 2 || fields[0] != "softdep" {
+		return "", false
+	}
+	return strings.Join(fields, " "), m.included(fields[1])
+}
+
+// modulesAliasIndex generates modules.alias.bin or modules.symbols.bin from the
+// contents of the text version. The key is the alias, and the value is the
+// module name.
+func modulesAliasIndex(text []byte) ([]byte, error) {
+	idx := newKmodIndex()
+	s := bufio.NewScanner(bytes.NewReader(text))
+	var priority uint32
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 || fields[0] != "alias" {
+			continue
+		}
+		if err := idx.insert(fields[1], fields[2], priority); err != nil {
+			return nil, err
+		}
+		priority++
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return idx.Bytes(), nil
+}
+
+// isGeneratedMetadata returns true if the given modules.* file is generated by
+// GenerateMetadata, and shouldn't be copied from the system
+func isGeneratedMetadata(path string) bool {
+	return generatedMetadata[filepath.Base(path)]
+}
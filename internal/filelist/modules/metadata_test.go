@@ -0,0 +1,106 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestGenerateMetadata(t *testing.T) {
+	root := writeModTree(t, map[string]string{
+		"lib/modules/6.1.0/modules.dep": `kernel/drivers/mmc/host/sdhci-msm.ko.zst: kernel/drivers/mmc/host/sdhci-pltfm.ko.zst kernel/drivers/mmc/core/mmc_core.ko.zst
+kernel/drivers/mmc/host/sdhci-pltfm.ko.zst:
+kernel/drivers/mmc/core/mmc_core.ko.zst:
+kernel/drivers/usb/storage/usb-storage.ko.zst:
+`,
+		"lib/modules/6.1.0/modules.alias": `# Aliases extracted from modules themselves.
+alias of:N*T*Cqcom,sdhci-msm-v4 sdhci_msm
+alias usb:v*p*d*dc*dsc*dp*ic08isc06ip50in* usb_storage
+`,
+		"lib/modules/6.1.0/modules.symbols": `# Aliases for symbols, used by symbol_request().
+alias symbol:sdhci_pltfm_init sdhci_pltfm
+alias symbol:usb_stor_probe1 usb_storage
+`,
+		"lib/modules/6.1.0/modules.softdep": `# Soft dependencies extracted from modules themselves.
+softdep sdhci_msm pre: crc32c
+softdep usb_storage pre: foo
+`,
+		"lib/modules/6.1.0/modules.devname": `# Device nodes to trigger on-demand module loading.
+mmc_core mmcblk0 b179:0
+fuse fuse c10:229
+`,
+	})
+	modDir := filepath.Join(root, "lib/modules/6.1.0")
+
+	files := []string{
+		"/bin/sh",
+		filepath.Join(modDir, "modules.builtin"),
+		// stored with a different compression than on the system
+		filepath.Join(modDir, "kernel/drivers/mmc/host/sdhci-msm.ko"),
+		filepath.Join(modDir, "kernel/drivers/mmc/host/sdhci-pltfm.ko"),
+		filepath.Join(modDir, "kernel/drivers/mmc/core/mmc_core.ko"),
+	}
+	generated, err := GenerateMetadata(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for path := range generated {
+		if filepath.Dir(path) != modDir {
+			t.Errorf("unexpected path for generated file: %q", path)
+		}
+		names = append(names, filepath.Base(path))
+	}
+	sort.Strings(names)
+	expectedNames := []string{"modules.alias", "modules.alias.bin", "modules.dep", "modules.dep.bin", "modules.devname", "modules.softdep", "modules.symbols", "modules.symbols.bin"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected files: %q, got: %q", expectedNames, names)
+	}
+
+	expected := map[string]string{
+		"modules.dep": `kernel/drivers/mmc/host/sdhci-msm.ko: kernel/drivers/mmc/host/sdhci-pltfm.ko kernel/drivers/mmc/core/mmc_core.ko
+kernel/drivers/mmc/host/sdhci-pltfm.ko:
+kernel/drivers/mmc/core/mmc_core.ko:
+`,
+		"modules.alias": `# Aliases extracted from modules themselves.
+alias of:N*T*Cqcom,sdhci-msm-v4 sdhci_msm
+`,
+		"modules.symbols": `# Aliases for symbols, used by symbol_request().
+alias symbol:sdhci_pltfm_init sdhci_pltfm
+`,
+		"modules.softdep": `# Soft dependencies extracted from modules themselves.
+softdep sdhci_msm pre: crc32c
+`,
+		"modules.devname": `# Device nodes to trigger on-demand module loading.
+mmc_core mmcblk0 b179:0
+`,
+	}
+	for name, contents := range expected {
+		if out := string(generated[filepath.Join(modDir, name)]); out != contents {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", name, contents, out)
+		}
+	}
+
+	lookups := []struct {
+		file     string
+		key      string
+		expected []string
+	}{
+		{"modules.dep.bin", "sdhci_pltfm", []string{"kernel/drivers/mmc/host/sdhci-pltfm.ko:"}},
+		{"modules.dep.bin", "usb_storage", nil},
+		{"modules.alias.bin", "of:N*T*Cqcom,sdhci-msm-v4", []string{"sdhci_msm"}},
+		{"modules.alias.bin", "usb:v*p*d*dc*dsc*dp*ic08isc06ip50in*", nil},
+		{"modules.symbols.bin", "symbol:sdhci_pltfm_init", []string{"sdhci_pltfm"}},
+	}
+	for _, l := range lookups {
+		out := kmodIndexLookup(t, generated[filepath.Join(modDir, l.file)], l.key)
+		if !reflect.DeepEqual(out, l.expected) {
+			t.Errorf("%s: %q: expected: %q, got: %q", l.file, l.key, l.expected, out)
+		}
+	}
+}
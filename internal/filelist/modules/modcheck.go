@@ -0,0 +1,89 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
+)
+
+// moduleSignatureMagic is at the end of modules that have a signature
+// appended, see scripts/sign-file.c in the kernel
+const moduleSignatureMagic = "~Module signature appended~\n"
+
+// signaturesRequired returns true if the config for the given kernel version
+// says that it only loads signed modules. If the config can't be found, it's
+// assumed that signatures aren't required. The kernel config is only read once
+// for each kernel version.
+func (c *Config) signaturesRequired(kernVer string) bool {
+	c.signaturesMu.Lock()
+	defer c.signaturesMu.Unlock()
+
+	if required, found := c.signatures[kernVer]; found {
+		return required
+	}
+
+	required := false
+	if config, _, err := osutil.GetKernelConfig(kernVer); err == nil {
+		required = config.BuiltIn("CONFIG_MODULE_SIG_FORCE")
+	}
+
+	if c.signatures == nil {
+		c.signatures = make(map[string]bool)
+	}
+	c.signatures[kernVer] = required
+
+	return required
+}
+
+// checkModules returns a description of each problem with the given modules
+// that would prevent the kernel from loading them: a vermagic that doesn't
+// match the kernel version, and if requireSignature is true, a missing
+// signature.
+func checkModules(config *Config, modules []string, kernVer string, requireSignature bool) (problems []string, err error) {
+	for _, module := range modules {
+		problem, err := checkModule(config, module, kernVer, requireSignature)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems, nil
+}
+
+func checkModule(config *Config, module string, kernVer string, requireSignature bool) (string, error) {
+	info, err := config.loadModinfo(module)
+	if err != nil {
+		return "", fmt.Errorf("unable to read modinfo for %q: %w", module, err)
+	}
+
+	// vermagic starts with the kernel version, followed by options like
+	// "SMP preempt mod_unload"
+	if len(info["vermagic"]) == 0 {
+		return fmt.Sprintf("module %q has no vermagic", module), nil
+	}
+	fields := strings.Fields(info["vermagic"][0])
+	if len(fields) == 0 || fields[0] != kernVer {
+		return fmt.Sprintf("module %q was built for kernel %q, not %q", module, info["vermagic"][0], kernVer), nil
+	}
+
+	if requireSignature {
+		data, err := misc.ReadFileDecompressed(module)
+		if err != nil {
+			return "", fmt.Errorf("unable to read %q: %w", module, err)
+		}
+		if !bytes.HasSuffix(data, []byte(moduleSignatureMagic)) {
+			return fmt.Sprintf("module %q is not signed, but the kernel requires signed modules", module), nil
+		}
+	}
+
+	return "", nil
+}
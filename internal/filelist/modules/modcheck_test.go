@@ -0,0 +1,68 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+)
+
+func TestCheckModule(t *testing.T) {
+	kernVer := "6.6.1-0-postmarketos"
+	vermagic := "vermagic=" + kernVer + " SMP preempt mod_unload aarch64"
+
+	signed := append(fakeModule(t, []string{vermagic}), []byte("signature"+moduleSignatureMagic)...)
+	compressed, err := misc.Compress(misc.ExtZstd, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := writeModTree(t, map[string]string{
+		"good.ko":        string(fakeModule(t, []string{vermagic})),
+		"signed.ko":      string(signed),
+		"signed.ko.zst":  string(compressed),
+		"stale.ko":       string(fakeModule(t, []string{"vermagic=6.5.0-0-postmarketos SMP preempt mod_unload aarch64"})),
+		"prefix.ko":      string(fakeModule(t, []string{"vermagic=" + kernVer + "-dirty SMP"})),
+		"no-vermagic.ko": string(fakeModule(t, []string{"license=GPL"})),
+	})
+
+	tables := []struct {
+		module           string
+		requireSignature bool
+		expected         string
+	}{
+		{"good.ko", false, ""},
+		{"good.ko", true, "is not signed"},
+		{"signed.ko", true, ""},
+		{"signed.ko.zst", true, ""},
+		{"stale.ko", false, "was built for kernel \"6.5.0-0-postmarketos SMP preempt mod_unload aarch64\""},
+		{"prefix.ko", false, "was built for kernel"},
+		{"no-vermagic.ko", false, "has no vermagic"},
+	}
+	for _, table := range tables {
+		problem, err := checkModule(&Config{}, filepath.Join(dir, table.module), kernVer, table.requireSignature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (table.expected == "") != (problem == "") || !strings.Contains(problem, table.expected) {
+			t.Errorf("%s: expected problem containing %q, got: %q", table.module, table.expected, problem)
+		}
+	}
+}
+
+func TestSignaturesRequired(t *testing.T) {
+	// there's no config for this kernel version, so signatures are only
+	// required if the cached value is used
+	const kernVer = "0.0.0-mkinitfs-test"
+	config := &Config{}
+	if config.signaturesRequired(kernVer) {
+		t.Error("expected signatures not to be required without a kernel config")
+	}
+	config.signatures[kernVer] = true
+	if !config.signaturesRequired(kernVer) {
+		t.Error("expected the cached value to be used")
+	}
+}
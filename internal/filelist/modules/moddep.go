@@ -0,0 +1,305 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+)
+
+// DepIndex is an index of the modules in a modules.dep file, and their
+// dependencies. Modules are looked up by name, with "-" and "_" treated as
+// the same character, the way kmod does.
+type DepIndex struct {
+	// module name -> path of the module, relative to the modules dir. If a
+	// module is in modules.dep more than once, this is the copy with the
+	// highest priority, see depmodConfig
+	paths map[string]string
+	// module name -> every path of the module in modules.dep, in order
+	candidates map[string][]string
+	// module path -> paths of the modules it depends on
+	deps map[string][]string
+	// module name -> names of modules it has a soft dependency on
+	softdeps map[string][]string
+	// modules that are blacklisted in modprobe.d
+	blacklist map[string]bool
+
+	// if set, soft dependencies are also read from the modinfo of modules
+	// in this dir, which is cached in config
+	modDir string
+	config *Config
+}
+
+// LoadDepIndex returns the DepIndex for modules.dep in the given modules dir,
+// with the modprobe.d and depmod.d configuration in the config dirs. The file
+// is only parsed once, later calls for the same dir and config dirs return the
+// same index.
+func (c *Config) LoadDepIndex(modDir string) (*DepIndex, error) {
+	c.depIndexesMu.Lock()
+	defer c.depIndexesMu.Unlock()
+
+	key := c.depIndexKey(modDir)
+	if idx, found := c.depIndexes[key]; found {
+		return idx, nil
+	}
+
+	modDep := filepath.Join(modDir, "modules.dep")
+	fd, err := os.Open(modDep)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open modules.dep: %w", err)
+	}
+	defer fd.Close()
+
+	idx, err := ParseModulesDep(fd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q: %w", modDep, err)
+	}
+	idx.modDir = modDir
+	idx.config = c
+
+	depmodCfg, err := readDepmodConfig(c.DepmodDirs, filepath.Base(modDir))
+	if err != nil {
+		return nil, err
+	}
+	idx.selectPaths(depmodCfg)
+
+	// soft dependencies from modprobe.d, and from modules.softdep, which
+	// depmod generates from the modinfo of all modules
+	cfg, err := ReadModprobeConfig(c.ModprobeDirs)
+	if err != nil {
+		return nil, err
+	}
+	modSoftdep := filepath.Join(modDir, "modules.softdep")
+	if exists, err := misc.Exists(modSoftdep); exists {
+		if err := cfg.readFile(modSoftdep); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("received unexpected error when getting status for %q: %w", modSoftdep, err)
+	}
+	idx.AddSoftDeps(cfg.SoftDeps)
+	for name := range cfg.Blacklist {
+		idx.AddBlacklist(name)
+	}
+
+	if c.depIndexes == nil {
+		c.depIndexes = make(map[string]*DepIndex)
+	}
+	c.depIndexes[key] = idx
+
+	return idx, nil
+}
+
+// ParseModulesDep returns a DepIndex for the modules.dep read from r. Modules
+// that are in it more than once are picked with the default depmod search
+// order, see defaultDepmodSearch.
+func ParseModulesDep(r io.Reader) (*DepIndex, error) {
+	idx := &DepIndex{
+		paths:      make(map[string]string),
+		candidates: make(map[string][]string),
+		deps:       make(map[string][]string),
+		softdeps:   make(map[string][]string),
+		blacklist:  make(map[string]bool),
+	}
+
+	s := bufio.NewScanner(r)
+	// lines for modules with lots of dependencies can get long
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		path, deps, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid line: %q", line)
+		}
+		name := moduleName(path)
+		idx.candidates[name] = append(idx.candidates[name], path)
+		idx.deps[path] = strings.Fields(deps)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	idx.selectPaths(newDepmodConfig())
+
+	return idx, nil
+}
+
+// selectPaths picks the copy of each module with the highest priority in the
+// given config. Copies with the same priority are picked in the order they are
+// in modules.dep.
+func (idx *DepIndex) selectPaths(cfg *depmodConfig) {
+	for name, candidates := range idx.candidates {
+		best := candidates[0]
+		for _, path := range candidates[1:] {
+			if cfg.priority(name, path) < cfg.priority(name, best) {
+				best = path
+			}
+		}
+		idx.paths[name] = best
+	}
+}
+
+// resolvePath returns the path of the copy of the given module that is
+// picked, see selectPaths. Paths of modules that aren't in modules.dep are
+// returned as-is.
+func (idx *DepIndex) resolvePath(path string) string {
+	if picked, found := idx.paths[moduleName(path)]; found {
+		return picked
+	}
+	return path
+}
+
+// Path returns the path of the module with the given name, relative to the
+// modules dir. The name can be given with or without a ".ko*" extension.
+func (idx *DepIndex) Path(name string) (string, bool) {
+	path, found := idx.paths[moduleName(name)]
+	return path, found
+}
+
+// Match returns the names of the modules that match the given shell pattern,
+// e.g. "snd-soc-*", sorted by name. "-" and "_" are treated as the same
+// character outside of bracket expressions.
+func (idx *DepIndex) Match(pattern string) (names []string) {
+	pattern = moduleNamePattern(pattern)
+	for name := range idx.paths {
+		if fnmatch(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// moduleNamePattern is like moduleName, but for a shell pattern. "-" is left
+// alone in bracket expressions, where it is used for ranges.
+func moduleNamePattern(pattern string) string {
+	out := []byte(pattern)
+	inClass := false
+	for i, c := range out {
+		switch {
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '-' && !inClass:
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
+
+// Deps returns the names of the modules that the given module directly
+// depends on, according to modules.dep
+func (idx *DepIndex) Deps(name string) (names []string) {
+	path, found := idx.Path(name)
+	if !found {
+		return
+	}
+	for _, dep := range idx.deps[path] {
+		names = append(names, moduleName(dep))
+	}
+	return
+}
+
+// AddSoftDeps adds the given soft dependencies to the index, the map is module
+// name -> names of the modules it has a soft dependency on.
+func (idx *DepIndex) AddSoftDeps(softdeps map[string][]string) {
+	for name, deps := range softdeps {
+		name = moduleName(name)
+		for _, dep := range deps {
+			idx.softdeps[name] = append(idx.softdeps[name], moduleName(dep))
+		}
+	}
+}
+
+// AddBlacklist marks the given module as blacklisted
+func (idx *DepIndex) AddBlacklist(name string) {
+	idx.blacklist[moduleName(name)] = true
+}
+
+// Blacklisted returns true if the given module is blacklisted. Blacklisted
+// modules are still included if another module depends on them, but not
+// through soft dependencies.
+func (idx *DepIndex) Blacklisted(name string) bool {
+	return idx.blacklist[moduleName(name)]
+}
+
+// Resolve returns the path of the module with the given name, followed by the
+// paths of all of its dependencies, including indirect ones. All paths are
+// relative to the modules dir. Dependencies that don't have their own entry in
+// modules.dep are still returned, but can't be resolved any further.
+//
+// Soft dependencies are resolved too, and their dependencies in turn. Soft
+// dependencies that aren't in modules.dep are skipped, since they may be
+// built into the kernel, and so are blacklisted ones.
+func (idx *DepIndex) Resolve(name string) ([]string, error) {
+	path, found := idx.Path(name)
+	if !found {
+		return nil, fmt.Errorf("module not found in modules.dep: %q", name)
+	}
+
+	paths := []string{path}
+	seen := map[string]bool{path: true}
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	for i := 0; i < len(paths); i++ {
+		name := moduleName(paths[i])
+		for _, dep := range idx.deps[paths[i]] {
+			add(idx.resolvePath(dep))
+		}
+
+		softdeps, err := idx.softDeps(name, paths[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, dep := range softdeps {
+			if idx.Blacklisted(dep) {
+				continue
+			}
+			if path, found := idx.Path(dep); found {
+				add(path)
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// softDeps returns the names of the modules that the given module has a soft
+// dependency on, from modprobe.d, modules.softdep and the module's modinfo.
+func (idx *DepIndex) softDeps(name string, path string) ([]string, error) {
+	deps := idx.softdeps[name]
+	if idx.modDir == "" {
+		return deps, nil
+	}
+
+	modPath := filepath.Join(idx.modDir, path)
+	if exists, _ := misc.Exists(modPath); !exists {
+		return deps, nil
+	}
+	info, err := idx.config.loadModinfo(modPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read modinfo for %q: %w", modPath, err)
+	}
+	deps = deps[:len(deps):len(deps)]
+	for _, softdep := range info["softdep"] {
+		deps = append(deps, parseModinfoSoftdep(softdep)...)
+	}
+
+	return deps, nil
+}
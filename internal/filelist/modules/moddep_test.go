@@ -0,0 +1,171 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeModTree writes the given files to a new temporary dir and returns its
+// path. files is the path of each file, relative to the dir -> its contents.
+// The dir is removed when the test finishes.
+func writeModTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// modDirFiles returns the files for a modules dir with the given modules.dep,
+// for writeModTree: modules.dep itself, and a module without modinfo for each
+// module in it. More files can be added to the returned map.
+func modDirFiles(t *testing.T, modulesDep string) map[string]string {
+	t.Helper()
+
+	files := map[string]string{"modules.dep": modulesDep}
+	for _, line := range strings.Split(strings.TrimSpace(modulesDep), "\n") {
+		file, _, _ := strings.Cut(line, ":")
+		files[file] = string(fakeModule(t, nil))
+	}
+	return files
+}
+
+func TestParseModulesDepInvalid(t *testing.T) {
+	if _, err := ParseModulesDep(strings.NewReader("kernel/foo.ko:\nkernel/bar.ko\n")); err == nil {
+		t.Error("expected error for line without \":\"")
+	}
+}
+
+func TestDepIndexLookup(t *testing.T) {
+	idx, err := ParseModulesDep(strings.NewReader(testModuleDep))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path, found := idx.Path("nls-iso8859-1.ko"); !found || path != "kernel/fs/nls/nls_iso8859-1.ko.xz" {
+		t.Errorf("unexpected path: %q, %v", path, found)
+	}
+	if _, found := idx.Path("bogus"); found {
+		t.Error("expected module not to be found")
+	}
+
+	matchTables := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"xt-*", []string{"xt_sctp", "xt_u32"}},
+		{"vmw_vsock_*", []string{"vmw_vsock_virtio_transport"}},
+		{"[a-c]*", []string{"act_ipt", "bar", "bazz", "crc32"}},
+		{"bogus*", nil},
+	}
+	for _, table := range matchTables {
+		if out := idx.Match(table.pattern); !reflect.DeepEqual(out, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.pattern, table.expected, out)
+		}
+	}
+
+	depsTables := []struct {
+		name     string
+		expected []string
+	}{
+		{"hidp", []string{"bluetooth", "rfkill", "ecdh_generic", "ecc"}},
+		{"bar", []string{"crc32", "bazz"}},
+		{"crc32", nil},
+		{"bogus", nil},
+	}
+	for _, table := range depsTables {
+		if out := idx.Deps(table.name); !reflect.DeepEqual(out, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.name, table.expected, out)
+		}
+	}
+}
+
+func TestLoadDepIndex(t *testing.T) {
+	etc := writeModTree(t, map[string]string{
+		"blacklist.conf": "blacklist bad_dep\n",
+		"softdep.conf":   "softdep foo pre: bad-dep post: other\n",
+	})
+	files := modDirFiles(t, `kernel/foo.ko: kernel/bar.ko
+kernel/bar.ko:
+kernel/bad_dep.ko:
+kernel/other.ko:
+kernel/soft.ko:
+`)
+	files["modules.softdep"] = "softdep bar post: soft\n"
+	modDir := writeModTree(t, files)
+
+	tables := []struct {
+		name        string
+		config      *Config
+		blacklisted bool
+		expected    []string
+	}{
+		{"no config", &Config{}, false, []string{
+			"kernel/foo.ko",
+			"kernel/bar.ko",
+			"kernel/soft.ko",
+		}},
+		{"modprobe.d", &Config{ModprobeDirs: []string{etc}}, true, []string{
+			"kernel/foo.ko",
+			"kernel/bar.ko",
+			"kernel/other.ko",
+			"kernel/soft.ko",
+		}},
+	}
+	for _, table := range tables {
+		idx, err := table.config.LoadDepIndex(modDir)
+		if err != nil {
+			t.Fatalf("%s: %s", table.name, err)
+		}
+		if idx.Blacklisted("bad-dep") != table.blacklisted {
+			t.Errorf("%s: expected blacklisted: %v", table.name, table.blacklisted)
+		}
+		out, err := idx.Resolve("foo")
+		if err != nil {
+			t.Fatalf("%s: %s", table.name, err)
+		}
+		if !reflect.DeepEqual(out, table.expected) {
+			t.Errorf("%s: expected: %q, got: %q", table.name, table.expected, out)
+		}
+
+		again, err := table.config.LoadDepIndex(modDir)
+		if err != nil {
+			t.Fatalf("%s: %s", table.name, err)
+		}
+		if again != idx {
+			t.Errorf("%s: expected the cached index", table.name)
+		}
+	}
+
+	// the config dirs are part of the cache key
+	config := &Config{}
+	idx, err := config.LoadDepIndex(modDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ModprobeDirs = []string{etc}
+	if idx, err = config.LoadDepIndex(modDir); err != nil {
+		t.Fatal(err)
+	}
+	if !idx.Blacklisted("bad_dep") {
+		t.Error("expected index for the new config dirs")
+	}
+
+	if _, err := config.LoadDepIndex(t.TempDir()); err == nil {
+		t.Error("expected error for modules dir without modules.dep")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"strings"
+
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
+)
+
+// loadModinfo is like readModinfo, but each module is only read once
+func (c *Config) loadModinfo(path string) (map[string][]string, error) {
+	c.modinfoMu.Lock()
+	defer c.modinfoMu.Unlock()
+
+	if info, found := c.modinfo[path]; found {
+		return info, nil
+	}
+	info, err := readModinfo(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.modinfo == nil {
+		c.modinfo = make(map[string]map[string][]string)
+	}
+	c.modinfo[path] = info
+	return info, nil
+}
+
+// readModinfo returns the fields in the .modinfo section of the kernel module
+// at the given path, which may be compressed. Fields can appear more than
+// once, e.g. "alias", so every value is returned.
+func readModinfo(path string) (map[string][]string, error) {
+	data, err := misc.ReadFileDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseModinfo(data)
+}
+
+// parseModinfo is like readModinfo, but with the contents of the module
+func parseModinfo(module []byte) (map[string][]string, error) {
+	f, err := elf.NewFile(bytes.NewReader(module))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse module: %w", err)
+	}
+	defer f.Close()
+
+	info := make(map[string][]string)
+	section := f.Section(".modinfo")
+	if section == nil {
+		return info, nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read .modinfo: %w", err)
+	}
+
+	// the section is a list of NUL-terminated key=value strings
+	for _, field := range bytes.Split(data, []byte{0}) {
+		key, value, found := strings.Cut(string(field), "=")
+		if !found {
+			continue
+		}
+		info[key] = append(info[key], value)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeModule returns a minimal relocatable ELF file, with a .modinfo section
+// that has the given key=value fields
+func fakeModule(t *testing.T, modinfo []string) []byte {
+	t.Helper()
+
+	modinfoData := []byte(strings.Join(modinfo, "\x00") + "\x00")
+	shstrtab := []byte("\x00.modinfo\x00.shstrtab\x00")
+
+	const ehdrSize = 64
+	const shdrSize = 64
+	modinfoOff := uint64(ehdrSize)
+	shstrtabOff := modinfoOff + uint64(len(modinfoData))
+	shOff := shstrtabOff + uint64(len(shstrtab))
+
+	var buf bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	hdr := elf.Header64{
+		Ident:     ident,
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shOff,
+		Ehsize:    ehdrSize,
+		Shentsize: shdrSize,
+		Shnum:     3,
+		Shstrndx:  2,
+	}
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC), Off: modinfoOff, Size: uint64(len(modinfoData)), Addralign: 1},
+		{Name: 10, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint64(len(shstrtab)), Addralign: 1},
+	}
+
+	for _, v := range []any{hdr, modinfoData, shstrtab, sections} {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestParseModinfo(t *testing.T) {
+	module := fakeModule(t, []string{
+		"alias=of:N*T*Cfoo,bar",
+		"alias=platform:foo",
+		"softdep=pre: crc32c",
+		"license=GPL v2",
+		"intree=Y",
+	})
+	info, err := parseModinfo(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"alias":   {"of:N*T*Cfoo,bar", "platform:foo"},
+		"softdep": {"pre: crc32c"},
+		"license": {"GPL v2"},
+		"intree":  {"Y"},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("expected: %q, got: %q", expected, info)
+	}
+
+	if _, err := parseModinfo([]byte("not a module")); err == nil {
+		t.Errorf("expected error parsing invalid module")
+	}
+}
+
+func TestLoadModinfo(t *testing.T) {
+	path := filepath.Join(writeModTree(t, map[string]string{
+		"foo.ko": string(fakeModule(t, []string{"license=GPL"})),
+	}), "foo.ko")
+
+	config := &Config{}
+	if _, err := config.loadModinfo(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, fakeModule(t, []string{"license=MIT"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		name     string
+		config   *Config
+		expected []string
+	}{
+		{"cached", config, []string{"GPL"}},
+		{"new config", &Config{}, []string{"MIT"}},
+	}
+	for _, table := range tables {
+		info, err := table.config.loadModinfo(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(info["license"], table.expected) {
+			t.Errorf("%s: expected: %q, got: %q", table.name, table.expected, info["license"])
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ModprobeConfig is the configuration from modprobe.d files, and the
+// modules.softdep file generated by depmod. Module names are normalized, see
+// moduleName.
+type ModprobeConfig struct {
+	// module name -> names of modules it has a soft dependency on, both
+	// pre: and post:
+	SoftDeps map[string][]string
+	// modules that shouldn't be loaded automatically
+	Blacklist map[string]bool
+	// module name -> parameters to load it with
+	Options map[string][]string
+
+	// supported commands in the order they were read, see Generate
+	commands []modprobeCommand
+}
+
+type modprobeCommand struct {
+	module string
+	line   string
+}
+
+func newModprobeConfig() *ModprobeConfig {
+	return &ModprobeConfig{
+		SoftDeps:  make(map[string][]string),
+		Blacklist: make(map[string]bool),
+		Options:   make(map[string][]string),
+	}
+}
+
+// ReadModprobeConfig reads all *.conf files in the given directories, with
+// files in earlier directories overriding files with the same name in later
+// ones. Files are processed in alphabetical order of their names, like
+// modprobe does. Directories that don't exist are skipped.
+func ReadModprobeConfig(dirs []string) (*ModprobeConfig, error) {
+	cfg := newModprobeConfig()
+	for _, path := range configFiles(dirs) {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// configFiles returns the paths of the *.conf files in the given directories,
+// sorted by file name. Files in earlier directories override files with the
+// same name in later ones, like modprobe and depmod do.
+func configFiles(dirs []string) (paths []string) {
+	files := make(map[string]string)
+	for _, dir := range dirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.conf"))
+		for _, path := range matches {
+			name := filepath.Base(path)
+			if _, found := files[name]; !found {
+				files[name] = path
+			}
+		}
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		paths = append(paths, files[name])
+	}
+	return
+}
+
+func (cfg *ModprobeConfig) readFile(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open %q: %w", path, err)
+	}
+	defer fd.Close()
+
+	if err := cfg.parse(fd); err != nil {
+		return fmt.Errorf("unable to parse %q: %w", path, err)
+	}
+	return nil
+}
+
+// parse reads modprobe.d configuration from r. Only the blacklist, options and
+// softdep commands are supported, anything else is ignored. install commands
+// in particular are left out, since the programs they run may not be in the
+// archive.
+func (cfg *ModprobeConfig) parse(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	var line string
+	for s.Scan() {
+		// lines ending in \ are continued on the next line
+		text := strings.TrimSpace(s.Text())
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line += text
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "blacklist", "options", "softdep":
+		default:
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("missing module name: %q", strings.Join(fields, " "))
+		}
+		name := moduleName(fields[1])
+		cfg.commands = append(cfg.commands, modprobeCommand{
+			module: name,
+			line:   strings.Join(fields, " "),
+		})
+
+		switch fields[0] {
+		case "blacklist":
+			cfg.Blacklist[name] = true
+		case "options":
+			cfg.Options[name] = append(cfg.Options[name], fields[2:]...)
+		case "softdep":
+			for _, dep := range fields[2:] {
+				if dep == "pre:" || dep == "post:" {
+					continue
+				}
+				cfg.SoftDeps[name] = append(cfg.SoftDeps[name], moduleName(dep))
+			}
+		}
+	}
+
+	return s.Err()
+}
+
+// parseModinfoSoftdep returns the module names listed in the value of a
+// softdep= field in a module's modinfo, e.g. "pre: crc32c post: foo"
+func parseModinfoSoftdep(value string) (deps []string) {
+	for _, dep := range strings.Fields(value) {
+		if dep == "pre:" || dep == "post:" {
+			continue
+		}
+		deps = append(deps, moduleName(dep))
+	}
+	return
+}
+
+// Generate returns modprobe.d configuration with the commands for the modules
+// in the given set of module names, in the order they were read.
+func (cfg *ModprobeConfig) Generate(modules map[string]bool) []byte {
+	var out bytes.Buffer
+	for _, c := range cfg.commands {
+		if modules[c.module] {
+			out.WriteString(c.line + "\n")
+		}
+	}
+	return out.Bytes()
+}
+
+// GenerateModprobeConfig returns the modprobe.d configuration from the config
+// dirs that applies to the kernel modules in the given list of files, so that
+// it can be included in an archive. If there is no configuration for any of
+// the modules, nil is returned.
+func GenerateModprobeConfig(config *Config, files []string) ([]byte, error) {
+	modules := make(map[string]bool)
+	for _, file := range files {
+		if isModule(file) {
+			modules[moduleName(file)] = true
+		}
+	}
+
+	cfg, err := ReadModprobeConfig(config.ModprobeDirs)
+	if err != nil {
+		return nil, err
+	}
+	conf := cfg.Generate(modules)
+	if len(conf) == 0 {
+		return nil, nil
+	}
+
+	return append([]byte("# Generated by mkinitfs from the modprobe.d configuration on the system\n"), conf...), nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package modules
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestModprobeConfigParse(t *testing.T) {
+	conf := `
+# comment
+softdep dm-crypt pre: crc32c
+softdep foo pre: bar-baz \
+	post: qux
+options foo bar=1
+softdep  ext4   pre:   crc32c   post:
+`
+	cfg := newModprobeConfig()
+	if err := cfg.parse(strings.NewReader(conf)); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"dm_crypt": {"crc32c"},
+		"foo":      {"bar_baz", "qux"},
+		"ext4":     {"crc32c"},
+	}
+	if !reflect.DeepEqual(cfg.SoftDeps, expected) {
+		t.Errorf("expected: %q, got: %q", expected, cfg.SoftDeps)
+	}
+
+	if err := cfg.parse(strings.NewReader("softdep")); err == nil {
+		t.Errorf("expected error for softdep without module name")
+	}
+}
+
+func TestReadModprobeConfig(t *testing.T) {
+	root := writeModTree(t, map[string]string{
+		"etc/foo.conf": "softdep foo pre: etc\n",
+		"lib/foo.conf": "softdep foo pre: lib\n",
+		"lib/bar.conf": "softdep bar pre: lib\n",
+		"lib/bar.txt":  "softdep bar pre: ignored\n",
+	})
+	etc, lib := filepath.Join(root, "etc"), filepath.Join(root, "lib")
+
+	cfg, err := ReadModprobeConfig([]string{etc, filepath.Join(etc, "missing"), lib})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"foo": {"etc"},
+		"bar": {"lib"},
+	}
+	if !reflect.DeepEqual(cfg.SoftDeps, expected) {
+		t.Errorf("expected: %q, got: %q", expected, cfg.SoftDeps)
+	}
+}
+
+func TestDepIndexResolveSoftDeps(t *testing.T) {
+	idx, err := ParseModulesDep(strings.NewReader(testModuleDep))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.AddSoftDeps(map[string][]string{
+		"gl518sm":   {"dw-wdt", "builtin_mod"},
+		"dw_wdt":    {"gpu_sched"},
+		"gpu-sched": {"gl518sm"},
+	})
+
+	expected := []string{
+		"kernel/drivers/hwmon/gl518sm.ko.xz",
+		"kernel/drivers/watchdog/dw_wdt.ko.xz",
+		"kernel/drivers/watchdog/watchdog.ko.xz",
+		"kernel/drivers/gpu/drm/scheduler/gpu-sched.ko.xz",
+	}
+	out, err := idx.Resolve("gl518sm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+func TestDepIndexResolveModinfoSoftDeps(t *testing.T) {
+	modDir := writeModTree(t, map[string]string{
+		"kernel/foo.ko":     string(fakeModule(t, []string{"softdep=pre: bar-mod post: missing", "license=GPL"})),
+		"kernel/bar-mod.ko": string(fakeModule(t, []string{"license=GPL"})),
+	})
+
+	idx, err := ParseModulesDep(strings.NewReader("kernel/foo.ko:\nkernel/bar-mod.ko:\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.modDir = modDir
+	idx.config = &Config{}
+
+	expected := []string{"kernel/foo.ko", "kernel/bar-mod.ko"}
+	out, err := idx.Resolve("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
+
+func TestModprobeConfigCommands(t *testing.T) {
+	conf := `
+blacklist vendor-wifi
+blacklist pcspkr
+install fake_mod /bin/true
+options vendor_wifi debug=1 \
+	country=NL
+options msm modeset=1
+options msm vram=64M
+alias my-alias msm
+softdep msm pre: foo
+`
+	cfg := newModprobeConfig()
+	if err := cfg.parse(strings.NewReader(conf)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedBlacklist := map[string]bool{"vendor_wifi": true, "pcspkr": true}
+	if !reflect.DeepEqual(cfg.Blacklist, expectedBlacklist) {
+		t.Errorf("expected blacklist: %v, got: %v", expectedBlacklist, cfg.Blacklist)
+	}
+	expectedOptions := map[string][]string{
+		"vendor_wifi": {"debug=1", "country=NL"},
+		"msm":         {"modeset=1", "vram=64M"},
+	}
+	if !reflect.DeepEqual(cfg.Options, expectedOptions) {
+		t.Errorf("expected options: %q, got: %q", expectedOptions, cfg.Options)
+	}
+
+	expected := `blacklist vendor-wifi
+options vendor_wifi debug=1 country=NL
+options msm modeset=1
+options msm vram=64M
+softdep msm pre: foo
+`
+	// install lines aren't shipped
+	out := cfg.Generate(map[string]bool{"msm": true, "vendor_wifi": true, "fake_mod": true, "other": true})
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestSlurpModulesBlacklist(t *testing.T) {
+	etc := writeModTree(t, map[string]string{"blacklist.conf": "blacklist vendor-wifi\nblacklist bad_dep\n"})
+	config := &Config{ModprobeDirs: []string{etc}}
+	modDir := writeModTree(t, modDirFiles(t, `kernel/drivers/net/vendor-wifi.ko:
+kernel/drivers/net/good-wifi.ko: kernel/drivers/net/bad_dep.ko
+kernel/drivers/net/bad_dep.ko:
+kernel/drivers/net/other.ko:
+`))
+
+	tables := []struct {
+		list     string
+		expected []string
+	}{
+		// hard dependencies of modules in the dir are included even if
+		// they are blacklisted
+		{"kernel/drivers/net/\n", []string{
+			"kernel/drivers/net/bad_dep.ko",
+			"kernel/drivers/net/good-wifi.ko",
+			"kernel/drivers/net/other.ko",
+		}},
+		{"kernel/drivers/net/!force\n", []string{
+			"kernel/drivers/net/bad_dep.ko",
+			"kernel/drivers/net/good-wifi.ko",
+			"kernel/drivers/net/other.ko",
+			"kernel/drivers/net/vendor-wifi.ko",
+		}},
+		{"vendor-wifi\n", nil},
+		{"vendor_wifi!force\n", []string{"kernel/drivers/net/vendor-wifi.ko"}},
+		// hard dependencies are included even if they are blacklisted
+		{"good-wifi\n", []string{
+			"kernel/drivers/net/bad_dep.ko",
+			"kernel/drivers/net/good-wifi.ko",
+		}},
+	}
+	for _, table := range tables {
+		out, err := slurpModules(config, strings.NewReader(table.list), modDir, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for f := range out.IterItems() {
+			rel, _ := filepath.Rel(modDir, f.Source)
+			got = append(got, rel)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.list, table.expected, got)
+		}
+	}
+
+	if _, err := slurpModules(config, strings.NewReader("other!bogus\n"), modDir, nil, true); err == nil {
+		t.Errorf("expected error for unknown option")
+	}
+}
+
+func TestDepIndexResolveBlacklistedSoftDeps(t *testing.T) {
+	idx, err := ParseModulesDep(strings.NewReader(testModuleDep))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.AddSoftDeps(map[string][]string{"gl518sm": {"dw-wdt", "gpu_sched"}})
+	idx.AddBlacklist("dw_wdt")
+
+	expected := []string{
+		"kernel/drivers/hwmon/gl518sm.ko.xz",
+		"kernel/drivers/gpu/drm/scheduler/gpu-sched.ko.xz",
+	}
+	out, err := idx.Resolve("gl518sm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
+}
@@ -2,30 +2,98 @@ package modules
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/filelist"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/misc"
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
+	"gitlab.com/postmarketOS/postmarketos-mkinitfs/pkgs/deviceinfo"
 )
 
 type Modules struct {
 	modulesListPath string
+	// conditions on lines in the lists are evaluated against this, see
+	// filelist.FilterConditions
+	devinfo deviceinfo.DeviceInfo
+	// for host-only mode
+	hostOnly    bool
+	sysfsRoot   string
+	procModules string
+	// don't include firmware listed in the modinfo of modules
+	skipFirmware bool
+	// only warn about entries in the lists that don't match any module
+	nonStrict bool
+	// only warn about modules that the kernel can't load, see checkModules
+	ignoreChecks bool
+	// device tree blobs to select modules with, instead of lists
+	dtbs []string
+	// the configuration that modules are resolved with
+	config *Config
 }
 
 // New returns a new Modules that will read in lists of kernel modules in the given path.
-func New(modulesListPath string) *Modules {
+func New(modulesListPath string, devinfo deviceinfo.DeviceInfo, config *Config) *Modules {
 	return &Modules{
 		modulesListPath: modulesListPath,
+		devinfo:         devinfo,
+		config:          config,
 	}
 }
 
+// NewHostOnly is like New, but modules from directories in the lists are
+// only included if the hardware on this system needs them, see
+// Config.LoadHostModules. Modules that are listed by name are always included.
+// sysfsRoot is the path to sysfs, e.g. "/sys", and procModules is the path to
+// the list of loaded modules, e.g. "/proc/modules". procModules can be empty
+// to only use the modaliases in sysfs.
+func NewHostOnly(modulesListPath string, sysfsRoot string, procModules string, devinfo deviceinfo.DeviceInfo, config *Config) *Modules {
+	return &Modules{
+		modulesListPath: modulesListPath,
+		devinfo:         devinfo,
+		config:          config,
+		hostOnly:        true,
+		sysfsRoot:       sysfsRoot,
+		procModules:     procModules,
+	}
+}
+
+// NewDtb returns a new Modules that includes the modules for the devices in
+// the given flattened device tree blobs, e.g. "/sys/firmware/fdt", instead of
+// reading lists of modules. Modules are matched by the "compatible" values of
+// each device, see dtbModules.
+func NewDtb(dtbs []string, config *Config) *Modules {
+	return &Modules{
+		dtbs:   dtbs,
+		config: config,
+	}
+}
+
+// SkipFirmware disables including the firmware that is listed in the modinfo
+// of the included modules.
+func (m *Modules) SkipFirmware() {
+	m.skipFirmware = true
+}
+
+// NonStrict makes entries in the lists that are neither a loadable module nor
+// built into the kernel a warning instead of an error.
+func (m *Modules) NonStrict() {
+	m.nonStrict = true
+}
+
+// IgnoreModuleChecks makes included modules that don't match the kernel, e.g.
+// because they were built for a different kernel version or aren't signed
+// when the kernel requires it, a warning instead of an error.
+func (m *Modules) IgnoreModuleChecks() {
+	m.ignoreChecks = true
+}
+
 func (m *Modules) List() (*filelist.FileList, error) {
 	kernVer, err := osutil.GetKernelVersion()
 	if err != nil {
@@ -49,10 +117,31 @@ func (m *Modules) List() (*filelist.FileList, error) {
 		return nil, fmt.Errorf("received unexpected error when getting status for %q: %w", modDir, err)
 	}
 
-	// modules.* required by modprobe
+	// modules.* required by modprobe. Files that describe modules are
+	// generated for each archive instead, see GenerateMetadata
 	modprobeFiles, _ := filepath.Glob(filepath.Join(modDir, "modules.*"))
 	for _, file := range modprobeFiles {
-		files.Add(file, file)
+		if isGeneratedMetadata(file) {
+			continue
+		}
+		files.AddFile(filelist.File{
+			Source: file,
+			Dest:   file,
+			Origin: filepath.Join(modDir, "modules.*"),
+		})
+	}
+
+	requireSignature := m.config.signaturesRequired(kernVer)
+	if m.dtbs != nil {
+		log.Printf("- Searching for kernel modules for the device tree in %q", m.dtbs)
+		list, err := dtbModules(m.config, m.dtbs, modDir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get modules for the device tree: %w", err)
+		}
+		if err := m.importModules(files, list, strings.Join(m.dtbs, " "), kernVer, requireSignature); err != nil {
+			return nil, err
+		}
+		return files, nil
 	}
 
 	// slurp up modules from lists in modulesListPath
@@ -61,6 +150,13 @@ func (m *Modules) List() (*filelist.FileList, error) {
 	if err != nil {
 		return files, nil
 	}
+
+	var hostModules map[string]bool
+	if m.hostOnly {
+		if hostModules, err = m.config.LoadHostModules(m.sysfsRoot, m.procModules, modDir); err != nil {
+			return nil, fmt.Errorf("unable to detect modules needed by this system: %w", err)
+		}
+	}
 	for _, file := range fileInfo {
 		path := filepath.Join(m.modulesListPath, file.Name())
 		f, err := os.Open(path)
@@ -70,52 +166,295 @@ func (m *Modules) List() (*filelist.FileList, error) {
 		defer f.Close()
 		log.Printf("-- Including modules from: %s\n", path)
 
-		if list, err := slurpModules(f, modDir); err != nil {
+		r, err := filelist.FilterConditions(f, m.devinfo)
+		if err != nil {
 			return nil, fmt.Errorf("unable to process module list file %q: %w", path, err)
-		} else {
-			files.Import(list)
+		}
+		list, err := slurpModules(m.config, r, modDir, hostModules, !m.nonStrict)
+		if err != nil {
+			return nil, fmt.Errorf("unable to process module list file %q: %w", path, err)
+		}
+		if err := m.importModules(files, list, path, kernVer, requireSignature); err != nil {
+			return nil, err
 		}
 	}
 	return files, nil
 }
 
-func slurpModules(fd io.Reader, modDir string) (*filelist.FileList, error) {
-	files := filelist.NewFileList()
+// importModules imports the given list of modules into files with the given
+// origin, after checking that the kernel can load them, along with the
+// firmware they need.
+func (m *Modules) importModules(files *filelist.FileList, list *filelist.FileList, origin string, kernVer string, requireSignature bool) error {
+	files.ImportFrom(list, origin)
+
+	var modules []string
+	for file := range list.IterItems() {
+		if isModule(file.Source) {
+			modules = append(modules, file.Source)
+		}
+	}
+	problems, err := checkModules(m.config, modules, kernVer, requireSignature)
+	if err != nil {
+		return fmt.Errorf("unable to check modules in %q: %w", origin, err)
+	}
+	for _, problem := range problems {
+		if m.ignoreChecks {
+			log.Printf("-- Warning: %s", problem)
+		} else {
+			log.Printf("-- Error: %s", problem)
+		}
+	}
+	if len(problems) > 0 && !m.ignoreChecks {
+		return fmt.Errorf("%d module(s) from %q can't be loaded by kernel %q", len(problems), origin, kernVer)
+	}
+
+	if m.skipFirmware {
+		return nil
+	}
+	firmware, err := getModulesFirmware(m.config, modules, kernVer)
+	if err != nil {
+		return fmt.Errorf("unable to get firmware for modules in %q: %w", origin, err)
+	}
+	files.ImportFrom(firmware, origin)
+	return nil
+}
+
+// moduleEntry is a line in a list of modules
+type moduleEntry struct {
+	lineNum int
+	// a directory relative to the modules dir, ending in "/", a module name,
+	// a glob on module names or a module alias
+	value    string
+	force    bool
+	optional bool
+}
+
+// parseModulesList returns the entries in the given list of modules, and the
+// module names or globs that are excluded with a "-" prefix
+func parseModulesList(fd io.Reader) (entries []moduleEntry, excludes []string, err error) {
 	s := bufio.NewScanner(fd)
+	lineNum := 0
 	for s.Scan() {
+		lineNum++
 		line := strings.TrimSpace(s.Text())
 		if len(line) == 0 || strings.HasPrefix(line, "#") {
 			continue
 		}
-		dir, file := filepath.Split(line)
-		if file == "" {
+
+		if exclude, found := strings.CutPrefix(line, "-"); found {
+			if exclude == "" || strings.ContainsAny(exclude, "/!:") {
+				return nil, nil, fmt.Errorf("line %d: invalid exclusion %q, only module names and globs can be excluded", lineNum, line)
+			}
+			excludes = append(excludes, exclude)
+			continue
+		}
+
+		value, options, _ := strings.Cut(line, "!")
+		e := moduleEntry{
+			lineNum: lineNum,
+			value:   value,
+		}
+		for _, o := range strings.Split(options, "!") {
+			switch o {
+			case "":
+			case "force":
+				e.force = true
+			case "optional":
+				e.optional = true
+			default:
+				return nil, nil, fmt.Errorf("line %d: unknown option %q in line: %q", lineNum, o, line)
+			}
+		}
+		if dir, file := filepath.Split(value); value == "" || (dir != "" && file != "") {
+			return nil, nil, fmt.Errorf("line %d: invalid module entry %q, directories must end in \"/\"", lineNum, line)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, excludes, s.Err()
+}
+
+// slurpModules returns the modules in the given list. If hostModules is not
+// nil, then modules in directories and name globs are only included if they
+// are in hostModules, along with their dependencies. Modules that are
+// blacklisted in modprobe.d are skipped, unless the entry has "!force", and so
+// are modules that are excluded with a "-" entry anywhere in the list. Modules
+// that included modules depend on are always included.
+//
+// Entries for modules that are built into the kernel are skipped. Entries
+// that don't match a loadable or built-in module are an error if strict is
+// true, otherwise a warning is logged. Entries with "!optional" are skipped
+// without a warning.
+func slurpModules(config *Config, fd io.Reader, modDir string, hostModules map[string]bool, strict bool) (*filelist.FileList, error) {
+	idx, err := config.LoadDepIndex(modDir)
+	if err != nil {
+		return nil, err
+	}
+	builtin, err := config.loadBuiltinModules(modDir)
+	if err != nil {
+		return nil, err
+	}
+	entries, excludes, err := parseModulesList(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	// skip returns true if the given module, that was found through the
+	// given entry, shouldn't be included
+	skip := func(e moduleEntry, name string) bool {
+		for _, exclude := range excludes {
+			if fnmatch(moduleNamePattern(exclude), moduleName(name)) {
+				return true
+			}
+		}
+		return idx.Blacklisted(name) && !e.force
+	}
+
+	notFound := func(e moduleEntry, msg string) error {
+		switch {
+		case e.optional:
+			log.Printf("-- Skipping optional module entry, %s", msg)
+		case strict:
+			return fmt.Errorf("line %d: %s", e.lineNum, msg)
+		default:
+			log.Printf("-- Warning: line %d: %s", e.lineNum, msg)
+		}
+		return nil
+	}
+
+	files := filelist.NewFileList()
+	addModule := func(e moduleEntry, name string) error {
+		modFilelist, err := getModule(config, name, modDir)
+		if err != nil {
+			return fmt.Errorf("line %d: unable to get module file %q: %w", e.lineNum, name, err)
+		}
+		for _, file := range modFilelist {
+			files.Add(file, file)
+		}
+		return nil
+	}
+
+	for _, e := range entries {
+		dir, file := filepath.Split(e.value)
+		switch {
+		case file == "":
 			// item is a directory
 			dir = filepath.Join(modDir, dir)
 			dirs, _ := filepath.Glob(dir)
 			for _, d := range dirs {
-				if modFilelist, err := getModulesInDir(d); err != nil {
-					return nil, fmt.Errorf("unable to get modules dir %q: %w", d, err)
-				} else {
-					for _, file := range modFilelist {
-						files.Add(file, file)
-					}
+				modFilelist, err := getModulesInDir(d)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: unable to get modules dir %q: %w", e.lineNum, d, err)
 				}
-			}
-		} else if dir == "" {
-			// item is a module name
-			if modFilelist, err := getModule(line, modDir); err != nil {
-				return nil, fmt.Errorf("unable to get module file %q: %w", line, err)
-			} else {
 				for _, file := range modFilelist {
+					if skip(e, file) {
+						continue
+					}
+					// the copy of the module that modprobe loads, if
+					// there's more than one, e.g. in updates/
+					if rel, err := filepath.Rel(modDir, file); err == nil {
+						file = filepath.Join(modDir, idx.resolvePath(rel))
+					}
+					if hostModules != nil && !hostModules[moduleName(file)] {
+						continue
+					}
 					files.Add(file, file)
+					if err := addModule(e, moduleName(file)); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case strings.Contains(e.value, ":"):
+			// item is a module alias, e.g. "of:N*T*Cqcom,pm8941-pwrkey",
+			// since module names can't contain ":"
+			names, err := matchAlias(config, e.value, modDir)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", e.lineNum, err)
+			}
+			if len(names) == 0 {
+				if builtins := builtin.aliases.match(e.value); len(builtins) > 0 {
+					log.Printf("-- Module for alias %q is built into the kernel, skipping", e.value)
+				} else if err := notFound(e, fmt.Sprintf("no modules found for alias %q", e.value)); err != nil {
+					return nil, err
+				}
+			}
+			for _, name := range names {
+				if skip(e, name) {
+					continue
+				}
+				if err := addModule(e, name); err != nil {
+					return nil, err
+				}
+			}
+		case strings.ContainsAny(e.value, "*?["):
+			// item is a glob on module names
+			names := idx.Match(e.value)
+			if len(names) == 0 {
+				if builtins := builtin.match(e.value); len(builtins) > 0 {
+					log.Printf("-- Modules matching %q are built into the kernel, skipping", e.value)
+				} else if err := notFound(e, fmt.Sprintf("no modules found matching %q", e.value)); err != nil {
+					return nil, err
+				}
+			}
+			for _, name := range names {
+				if skip(e, name) || (hostModules != nil && !hostModules[name]) {
+					continue
+				}
+				if err := addModule(e, name); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			// item is a module name, or else an alias, e.g. "fs-ext4"
+			if skip(e, e.value) {
+				log.Printf("-- Skipping module that is excluded or blacklisted in modprobe.d: %q", e.value)
+				continue
+			}
+			if _, found := idx.Path(e.value); found {
+				if err := addModule(e, e.value); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if builtin.isBuiltin(e.value) {
+				log.Printf("-- Module is built into the kernel, skipping: %q", e.value)
+				continue
+			}
+			names, err := matchAlias(config, e.value, modDir)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", e.lineNum, err)
+			}
+			if len(names) == 0 {
+				if builtins := builtin.aliases.match(e.value); len(builtins) > 0 {
+					log.Printf("-- Module is built into the kernel, skipping: %q", e.value)
+				} else if err := notFound(e, fmt.Sprintf("module %q is neither a loadable module nor built into the kernel", e.value)); err != nil {
+					return nil, err
+				}
+			}
+			for _, name := range names {
+				if skip(e, name) {
+					continue
+				}
+				if err := addModule(e, name); err != nil {
+					return nil, err
 				}
 			}
-		} else {
-			log.Printf("Unknown module entry: %q", line)
 		}
 	}
 
-	return files, s.Err()
+	return files, nil
+}
+
+// matchAlias returns the names of the modules with an alias in modules.alias
+// that matches the given alias. If there's no modules.alias, nothing matches.
+func matchAlias(config *Config, alias string, modDir string) ([]string, error) {
+	aliases, err := config.loadAliasIndex(modDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return aliases.match(alias), nil
 }
 
 func getModulesInDir(modPath string) (files []string, err error) {
@@ -126,7 +465,7 @@ func getModulesInDir(modPath string) (files []string, err error) {
 		}
 		// this assumes module names are in the format <name>.ko[.format],
 		// where ".format" (e.g. ".gz") is optional.
-		if !strings.Contains(".ko", path) {
+		if !isModule(path) {
 			return nil
 		}
 		files = append(files, path)
@@ -143,22 +482,16 @@ func getModulesInDir(modPath string) (files []string, err error) {
 // file and all of its dependencies.
 // Note: it's not necessarily fatal if the module is not found, since it may
 // have been built into the kernel
-func getModule(modName string, modDir string) (files []string, err error) {
-
-	modDep := filepath.Join(modDir, "modules.dep")
-	if exists, err := misc.Exists(modDep); !exists {
-		return nil, fmt.Errorf("kernel module.dep not found: %s", modDir)
-	} else if err != nil {
-		return nil, fmt.Errorf("received unexpected error when getting module.dep status: %w", err)
-	}
-
-	fd, err := os.Open(modDep)
+func getModule(config *Config, modName string, modDir string) (files []string, err error) {
+	idx, err := config.LoadDepIndex(modDir)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open modules.dep: %w", err)
+		return nil, err
 	}
-	defer fd.Close()
 
-	deps, err := getModuleDeps(modName, fd)
+	if _, found := idx.Path(modName); !found {
+		return nil, nil
+	}
+	deps, err := idx.Resolve(modName)
 	if err != nil {
 		return nil, err
 	}
@@ -177,42 +510,6 @@ func getModule(modName string, modDir string) (files []string, err error) {
 	return
 }
 
-// Get the canonicalized name for the module as represented in the given modules.dep io.reader
-func getModuleDeps(modName string, modulesDep io.Reader) ([]string, error) {
-	var deps []string
-
-	// split the module name on - and/or _, build a regex for matching
-	splitRe := regexp.MustCompile("[-_]+")
-	modNameReStr := splitRe.ReplaceAllString(modName, "[-_]+")
-	re := regexp.MustCompile("^" + modNameReStr + "$")
-
-	s := bufio.NewScanner(modulesDep)
-	for s.Scan() {
-		line := strings.TrimSpace(s.Text())
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		fields := strings.Fields(line)
-		if len(fields) == 0 {
-			continue
-		}
-		fields[0] = strings.TrimSuffix(fields[0], ":")
-
-		found := re.FindAll([]byte(filepath.Base(stripExts(fields[0]))), -1)
-		if len(found) > 0 {
-			deps = append(deps, fields...)
-			break
-		}
-	}
-	if err := s.Err(); err != nil {
-		log.Print("Unable to get module + dependencies: ", modName)
-		return deps, err
-	}
-
-	return deps, nil
-}
-
 func stripExts(file string) string {
 	return strings.Split(file, ".")[0]
 }
@@ -4,6 +4,9 @@
 package modules
 
 import (
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -44,30 +47,86 @@ kernel/fs/nls/nls_iso8859-1.ko.xz:
 kernel/net/vmw_vsock/vmw_vsock_virtio_transport.ko.xz: kernel/net/vmw_vsock/vmw_vsock_virtio_transport_common.ko.xz kernel/drivers/virtio/virtio.ko.xz kernel/drivers/virtio/virtio_ring.ko.xz kernel/net/vmw_vsock/vsock.ko.xz
 kernel/drivers/gpu/drm/panfrost/panfrost.ko.xz: kernel/drivers/gpu/drm/scheduler/gpu-sched.ko.xz
 kernel/drivers/gpu/drm/msm/msm.ko: kernel/drivers/gpu/drm/drm_kms_helper.ko
+kernel/foo.ko.gz: kernel/bar.ko.gz
+kernel/bar.ko.gz: kernel/lib/crc32.ko.zst kernel/bazz.ko.gz
+kernel/bazz.ko.gz: kernel/lib/crc32.ko.zst
+kernel/lib/crc32.ko.zst:
 `
 
-func TestGetModuleDeps(t *testing.T) {
+func TestDepIndexResolve(t *testing.T) {
+	idx, err := ParseModulesDep(strings.NewReader(testModuleDep))
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	tables := []struct {
 		in       string
 		expected []string
 	}{
 		{"nls-iso8859-1", []string{"kernel/fs/nls/nls_iso8859-1.ko.xz"}},
+		{"nls_iso8859_1", []string{"kernel/fs/nls/nls_iso8859-1.ko.xz"}},
 		{"gpu_sched", []string{"kernel/drivers/gpu/drm/scheduler/gpu-sched.ko.xz"}},
 		{"dw-wdt", []string{"kernel/drivers/watchdog/dw_wdt.ko.xz",
 			"kernel/drivers/watchdog/watchdog.ko.xz"}},
+		{"dw_wdt.ko", []string{"kernel/drivers/watchdog/dw_wdt.ko.xz",
+			"kernel/drivers/watchdog/watchdog.ko.xz"}},
 		{"gl518sm", []string{"kernel/drivers/hwmon/gl518sm.ko.xz"}},
 		{"msm", []string{"kernel/drivers/gpu/drm/msm/msm.ko",
 			"kernel/drivers/gpu/drm/drm_kms_helper.ko"}},
+		{"snd_soc_msm8916_digital", []string{"kernel/sound/soc/codecs/snd-soc-msm8916-digital.ko"}},
+		{"crc32", []string{"kernel/lib/crc32.ko.zst"}},
+		// transitive dependencies
+		{"foo", []string{"kernel/foo.ko.gz",
+			"kernel/bar.ko.gz",
+			"kernel/lib/crc32.ko.zst",
+			"kernel/bazz.ko.gz"}},
 	}
 	for _, table := range tables {
-		out, err := getModuleDeps(table.in, strings.NewReader(testModuleDep))
+		out, err := idx.Resolve(table.in)
 		if err != nil {
-			t.Errorf("unexpected error with input: %q, error: %q", table.expected, err)
+			t.Errorf("unexpected error with input: %q, error: %q", table.in, err)
 		}
 		if !stringSlicesEqual(out, table.expected) {
 			t.Errorf("Expected: %q, got: %q", table.expected, out)
 		}
 	}
+
+	if _, err := idx.Resolve("dw"); err == nil {
+		t.Errorf("expected error for module that isn't in modules.dep")
+	}
+	if _, found := idx.Path("watchdog.ko.xz"); !found {
+		t.Errorf("expected to find module by file name")
+	}
+}
+
+func TestSlurpModulesDir(t *testing.T) {
+	modDir := writeModTree(t, modDirFiles(t, `kernel/drivers/foo/foo.ko: kernel/lib/crc32.ko
+kernel/drivers/foo/bar.ko:
+kernel/lib/crc32.ko:
+kernel/lib/other.ko:
+`))
+
+	list, err := slurpModules(&Config{}, strings.NewReader("kernel/drivers/foo/\n"), modDir, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for src := range list.IterItems() {
+		rel, err := filepath.Rel(modDir, src.Source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, rel)
+	}
+	sort.Strings(out)
+	expected := []string{
+		"kernel/drivers/foo/bar.ko",
+		"kernel/drivers/foo/foo.ko",
+		"kernel/lib/crc32.ko",
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected: %q, got: %q", expected, out)
+	}
 }
 
 func stringSlicesEqual(a []string, b []string) bool {
@@ -81,3 +140,78 @@ func stringSlicesEqual(a []string, b []string) bool {
 	}
 	return true
 }
+
+func TestSlurpModulesSyntax(t *testing.T) {
+	files := modDirFiles(t, `kernel/sound/soc/codecs/snd-soc-wcd9335.ko: kernel/sound/soc/snd-soc-core.ko
+kernel/sound/soc/codecs/snd-soc-wsa881x.ko: kernel/sound/soc/snd-soc-core.ko
+kernel/sound/soc/snd-soc-core.ko:
+kernel/fs/ext4/ext4.ko: kernel/lib/crc16.ko
+kernel/lib/crc16.ko:
+kernel/drivers/input/misc/pm8941-pwrkey.ko:
+`)
+	files["modules.alias"] = `alias fs-ext4 ext4
+alias of:N*T*Cqcom,pm8941-pwrkeyC* pm8941_pwrkey
+alias of:N*T*Cqcom,pm8941-pwrkey pm8941_pwrkey
+`
+	modDir := writeModTree(t, files)
+
+	tables := []struct {
+		list     string
+		expected []string
+	}{
+		{"snd-soc-*\n", []string{
+			"kernel/sound/soc/codecs/snd-soc-wcd9335.ko",
+			"kernel/sound/soc/codecs/snd-soc-wsa881x.ko",
+			"kernel/sound/soc/snd-soc-core.ko",
+		}},
+		{"snd_soc_w[a-c]*\n", []string{
+			"kernel/sound/soc/codecs/snd-soc-wcd9335.ko",
+			"kernel/sound/soc/snd-soc-core.ko",
+		}},
+		// exclusions apply to the whole list, but not to dependencies
+		{"snd-soc-*\n-snd-soc-wsa*\n-snd_soc_core\n", []string{
+			"kernel/sound/soc/codecs/snd-soc-wcd9335.ko",
+			"kernel/sound/soc/snd-soc-core.ko",
+		}},
+		{"-snd-soc-w*\nkernel/sound/\n", []string{"kernel/sound/soc/snd-soc-core.ko"}},
+		{"ext4\n-ext4\n", nil},
+		{"fs-ext4\n", []string{
+			"kernel/fs/ext4/ext4.ko",
+			"kernel/lib/crc16.ko",
+		}},
+		{"of:NpwrkeyT(null)Cqcom,pm8941-pwrkey\n", []string{"kernel/drivers/input/misc/pm8941-pwrkey.ko"}},
+		{"bogus-*!optional\nof:Nfoo!optional\n", nil},
+	}
+	for _, table := range tables {
+		out, err := slurpModules(&Config{}, strings.NewReader(table.list), modDir, nil, true)
+		if err != nil {
+			t.Fatalf("%q: %s", table.list, err)
+		}
+		var got []string
+		for f := range out.IterItems() {
+			rel, _ := filepath.Rel(modDir, f.Source)
+			got = append(got, rel)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("%q: expected: %q, got: %q", table.list, table.expected, got)
+		}
+	}
+
+	errTables := []struct {
+		list     string
+		expected string
+	}{
+		{"ext4\n\nbogus-*\n", "line 3: no modules found matching \"bogus-*\""},
+		{"# comment\nof:Nfoo\n", "line 2: no modules found for alias \"of:Nfoo\""},
+		{"kernel/fs/ext4/ext4.ko\n", "line 1: invalid module entry"},
+		{"ext4\n-kernel/fs/\n", "line 2: invalid exclusion"},
+		{"ext4!bogus\n", "line 1: unknown option \"bogus\""},
+	}
+	for _, table := range errTables {
+		_, err := slurpModules(&Config{}, strings.NewReader(table.list), modDir, nil, true)
+		if err == nil || !strings.HasPrefix(err.Error(), table.expected) {
+			t.Errorf("%q: expected error starting with %q, got: %v", table.list, table.expected, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package misc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Extensions used for compressed kernel modules and firmware files
+const (
+	ExtGzip = ".gz"
+	ExtXz   = ".xz"
+	ExtZstd = ".zst"
+)
+
+// CompressionExt returns the compression extension (one of the Ext* consts)
+// of the given file name, or an empty string if the name doesn't end in one.
+func CompressionExt(name string) string {
+	switch ext := filepath.Ext(name); ext {
+	case ExtGzip, ExtXz, ExtZstd:
+		return ext
+	}
+	return ""
+}
+
+// Decompress returns the decompressed contents of data, using the format
+// for the given extension. If ext is empty, then data is returned as-is.
+func Decompress(ext string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch ext {
+	case "":
+		return data, nil
+	case ExtGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case ExtXz:
+		x, err := xz.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = x
+	case ExtZstd:
+		z, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		r = z
+	default:
+		return nil, fmt.Errorf("unsupported compression format: %q", ext)
+	}
+
+	return io.ReadAll(r)
+}
+
+// Compress returns data compressed with the format for the given extension,
+// using settings the kernel is able to decompress. If ext is empty, then
+// data is returned as-is.
+func Compress(ext string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch ext {
+	case "":
+		return data, nil
+	case ExtGzip:
+		gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = gz
+	case ExtXz:
+		// The kernel's xz decompressor only supports crc32 checks
+		x, err := xz.WriterConfig{CheckSum: xz.CRC32, DictCap: 1 << 20}.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = x
+	case ExtZstd:
+		z, err := zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		w = z
+	default:
+		return nil, fmt.Errorf("unsupported compression format: %q", ext)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ReadFileDecompressed reads the given file, and decompresses it if the file
+// name has a compression extension.
+func ReadFileDecompressed(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Decompress(CompressionExt(file), data)
+}
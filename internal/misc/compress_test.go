@@ -0,0 +1,55 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package misc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressionExt(t *testing.T) {
+	tables := []struct {
+		in       string
+		expected string
+	}{
+		{"/lib/modules/6.1/kernel/foo.ko", ""},
+		{"/lib/modules/6.1/kernel/foo.ko.gz", ExtGzip},
+		{"/lib/modules/6.1/kernel/foo.ko.xz", ExtXz},
+		{"/lib/firmware/foo.bin.zst", ExtZstd},
+		{"/lib/firmware/foo.bz2", ""},
+	}
+	for _, table := range tables {
+		out := CompressionExt(table.in)
+		if out != table.expected {
+			t.Errorf("Expected: %q, got: %q", table.expected, out)
+		}
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("mkinitfs compression test data\n"), 1000)
+
+	for _, ext := range []string{"", ExtGzip, ExtXz, ExtZstd} {
+		t.Run(ext, func(t *testing.T) {
+			compressed, err := Compress(ext, data)
+			if err != nil {
+				t.Fatal("unexpected error compressing: ", err)
+			}
+			if ext != "" && len(compressed) >= len(data) {
+				t.Errorf("compressed data is not smaller: %d >= %d", len(compressed), len(data))
+			}
+			out, err := Decompress(ext, compressed)
+			if err != nil {
+				t.Fatal("unexpected error decompressing: ", err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Error("decompressed data doesn't match original")
+			}
+		})
+	}
+
+	if _, err := Compress(".bz2", data); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
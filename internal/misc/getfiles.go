@@ -2,6 +2,7 @@ package misc
 
 import (
 	"debug/elf"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -10,9 +11,23 @@ import (
 	"gitlab.com/postmarketOS/postmarketos-mkinitfs/internal/osutil"
 )
 
+// GetFilesOptions change which files GetFilesWith returns
+type GetFilesOptions struct {
+	// Don't include the libraries that ELF binaries depend on
+	NoDeps bool
+	// Only include symlinks, not their targets
+	NoFollow bool
+}
+
 func GetFiles(list []string, required bool) (files []string, err error) {
+	return GetFilesWith(list, required, GetFilesOptions{})
+}
+
+// GetFilesWith is like GetFiles, but with options to change which files are
+// returned.
+func GetFilesWith(list []string, required bool, opts GetFilesOptions) (files []string, err error) {
 	for _, file := range list {
-		filelist, err := getFile(file, required)
+		filelist, err := getFileWith(file, required, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -23,7 +38,7 @@ func GetFiles(list []string, required bool) (files []string, err error) {
 	return
 }
 
-func getFile(file string, required bool) (files []string, err error) {
+func getFileWith(file string, required bool, opts GetFilesOptions) (files []string, err error) {
 	// Expand glob expression
 	expanded, err := filepath.Glob(file)
 	if err != nil {
@@ -31,7 +46,7 @@ func getFile(file string, required bool) (files []string, err error) {
 	}
 	if len(expanded) > 0 && expanded[0] != file {
 		for _, path := range expanded {
-			if globFiles, err := getFile(path, required); err != nil {
+			if globFiles, err := getFileWith(path, required, opts); err != nil {
 				return files, err
 			} else {
 				files = append(files, globFiles...)
@@ -50,6 +65,9 @@ func getFile(file string, required bool) (files []string, err error) {
 	if s, err := os.Lstat(file); err == nil {
 		if s.Mode()&fs.ModeSymlink != 0 {
 			files = append(files, file)
+			if opts.NoFollow {
+				return files, nil
+			}
 			if target, err := filepath.EvalSymlinks(file); err != nil {
 				return files, err
 			} else {
@@ -60,18 +78,25 @@ func getFile(file string, required bool) (files []string, err error) {
 
 	fileInfo, err := os.Stat(file)
 	if err != nil {
-		// Check if there is a Zstd-compressed version of the file
-		fileZstd := file + ".zst" // .zst is the extension used by linux-firmware
-		fileInfoZstd, errZstd := os.Stat(fileZstd)
-
-		if errZstd == nil {
-			file = fileZstd
-			fileInfo = fileInfoZstd
-			// Unset nil so we don't retain the error from the os.Stat call for the uncompressed version.
-			err = nil
-		} else {
+		// Check if there is a compressed version of the file, these are the
+		// extensions used by linux-firmware
+		var errs []error
+		for _, ext := range []string{ExtZstd, ExtXz} {
+			fileCompressed := file + ext
+			fileInfoCompressed, errCompressed := os.Stat(fileCompressed)
+			if errCompressed == nil {
+				file = fileCompressed
+				fileInfo = fileInfoCompressed
+				// Unset nil so we don't retain the error from the os.Stat call for the uncompressed version.
+				err = nil
+				break
+			}
+			errs = append(errs, fmt.Errorf("also tried %q: %w", fileCompressed, errCompressed))
+		}
+
+		if err != nil {
 			if required {
-				return files, fmt.Errorf("getFile: failed to stat file %q: %w (also tried %q: %w)", file, err, fileZstd, errZstd)
+				return files, fmt.Errorf("getFile: failed to stat file %q: %w (%w)", file, err, errors.Join(errs...))
 			}
 
 			return files, nil
@@ -87,7 +112,7 @@ func getFile(file string, required bool) (files []string, err error) {
 			if f.IsDir() {
 				return nil
 			}
-			newFiles, err := getFile(path, required)
+			newFiles, err := getFileWith(path, required, opts)
 			if err != nil {
 				return err
 			}
@@ -101,6 +126,9 @@ func getFile(file string, required bool) (files []string, err error) {
 		files = append(files, file)
 
 		// get dependencies for binaries
+		if opts.NoDeps {
+			return files, nil
+		}
 		if _, err := elf.Open(file); err == nil {
 			if binaryDepFiles, err := getBinaryDeps(file); err != nil {
 				return files, err
@@ -17,6 +17,7 @@ func TestGetFile(t *testing.T) {
 		name     string
 		setup    func(tmpDir string) (inputPath string, expectedFiles []string, err error)
 		required bool
+		opts     GetFilesOptions
 	}{
 		{
 			name: "symlink to directory - no infinite recursion",
@@ -47,6 +48,27 @@ func TestGetFile(t *testing.T) {
 			},
 			required: true,
 		},
+		{
+			name: "symlink with NoFollow - returns only the symlink",
+			setup: func(tmpDir string) (string, []string, error) {
+				targetDir := filepath.Join(tmpDir, "target")
+				if err := os.MkdirAll(targetDir, 0755); err != nil {
+					return "", nil, err
+				}
+				if err := os.WriteFile(filepath.Join(targetDir, "file1.txt"), []byte("content1"), 0644); err != nil {
+					return "", nil, err
+				}
+
+				symlinkPath := filepath.Join(tmpDir, "symlink")
+				if err := os.Symlink(targetDir, symlinkPath); err != nil {
+					return "", nil, err
+				}
+
+				return symlinkPath, []string{symlinkPath}, nil
+			},
+			required: true,
+			opts:     GetFilesOptions{NoFollow: true},
+		},
 		{
 			name: "symlink to file - returns both symlink and target",
 			setup: func(tmpDir string) (string, []string, error) {
@@ -125,6 +147,24 @@ func TestGetFile(t *testing.T) {
 			},
 			required: true,
 		},
+		{
+			name: "xz compressed file fallback",
+			setup: func(tmpDir string) (string, []string, error) {
+				// Create a .xz file but NOT the original file
+				xzFile := filepath.Join(tmpDir, "firmware.bin.xz")
+				if err := os.WriteFile(xzFile, []byte("compressed content"), 0644); err != nil {
+					return "", nil, err
+				}
+
+				// Request the original file (without .xz extension)
+				originalFile := filepath.Join(tmpDir, "firmware.bin")
+
+				// Expected: should find and return the .xz version
+				expected := []string{xzFile}
+				return originalFile, expected, nil
+			},
+			required: true,
+		},
 	}
 
 	for _, st := range subtests {
@@ -143,7 +183,7 @@ func TestGetFile(t *testing.T) {
 
 			go func() {
 				defer close(done)
-				files, getFileErr = getFile(inputPath, st.required)
+				files, getFileErr = getFileWith(inputPath, st.required, st.opts)
 			}()
 
 			select {
@@ -0,0 +1,106 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package osutil
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KernelConfig holds the options set in a kernel config file, e.g.
+// "CONFIG_RD_GZIP" -> "y". Options that are not set are not included.
+type KernelConfig map[string]string
+
+// BuiltIn returns true if the given option is set to "y"
+func (k KernelConfig) BuiltIn(option string) bool {
+	return k[option] == "y"
+}
+
+// Enabled returns true if the given option is set to "y" or "m"
+func (k KernelConfig) Enabled(option string) bool {
+	return k[option] == "y" || k[option] == "m"
+}
+
+// kernelConfigPaths returns the locations to search for the config of the
+// given kernel version, in order of preference.
+func kernelConfigPaths(kernVer string) []string {
+	paths := []string{
+		filepath.Join("/boot", "config-"+kernVer),
+	}
+	if releaseFile, err := getKernelReleaseFile(); err == nil {
+		paths = append(paths, filepath.Join(filepath.Dir(releaseFile), "config"))
+	}
+	paths = append(paths,
+		filepath.Join("/usr/lib/modules", kernVer, "config"),
+		filepath.Join("/lib/modules", kernVer, "config"),
+	)
+
+	return paths
+}
+
+// GetKernelConfig locates and reads the config for the given kernel version.
+// The config file may be plain text, or gzip-compressed.
+func GetKernelConfig(kernVer string) (KernelConfig, string, error) {
+	for _, path := range kernelConfigPaths(kernVer) {
+		for _, p := range []string{path, path + ".gz"} {
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+			config, err := ReadKernelConfig(p)
+			return config, p, err
+		}
+	}
+
+	return nil, "", fmt.Errorf("unable to find kernel config for kernel version %q", kernVer)
+}
+
+// ReadKernelConfig reads the kernel config file at the given path, which may be
+// gzip-compressed.
+func ReadKernelConfig(path string) (KernelConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress kernel config %q: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	config, err := parseKernelConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read kernel config %q: %w", path, err)
+	}
+
+	return config, nil
+}
+
+func parseKernelConfig(r io.Reader) (KernelConfig, error) {
+	config := make(KernelConfig)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		option, value, found := strings.Cut(line, "=")
+		if !found || value == "n" {
+			continue
+		}
+		config[option] = strings.Trim(value, "\"")
+	}
+
+	return config, s.Err()
+}
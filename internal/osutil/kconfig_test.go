@@ -0,0 +1,70 @@
+// Copyright 2026 Clayton Craft <clayton@craftyguy.net>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package osutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testKernelConfig = `#
+# Automatically generated file; DO NOT EDIT.
+#
+CONFIG_CC_VERSION_TEXT="gcc (Alpine 14.2.0) 14.2.0"
+CONFIG_RD_GZIP=y
+# CONFIG_RD_BZIP2 is not set
+CONFIG_RD_ZSTD=y
+CONFIG_FW_LOADER_COMPRESS=y
+CONFIG_FW_LOADER_COMPRESS_XZ=y
+# CONFIG_FW_LOADER_COMPRESS_ZSTD is not set
+CONFIG_ZRAM=m
+CONFIG_FOO=n
+`
+
+func TestReadKernelConfig(t *testing.T) {
+	expected := KernelConfig{
+		"CONFIG_CC_VERSION_TEXT":       "gcc (Alpine 14.2.0) 14.2.0",
+		"CONFIG_RD_GZIP":               "y",
+		"CONFIG_RD_ZSTD":               "y",
+		"CONFIG_FW_LOADER_COMPRESS":    "y",
+		"CONFIG_FW_LOADER_COMPRESS_XZ": "y",
+		"CONFIG_ZRAM":                  "m",
+	}
+
+	tmpDir := t.TempDir()
+	plain := filepath.Join(tmpDir, "config")
+	if err := os.WriteFile(plain, []byte(testKernelConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(testKernelConfig))
+	gz.Close()
+	compressed := filepath.Join(tmpDir, "config.gz")
+	if err := os.WriteFile(compressed, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{plain, compressed} {
+		config, err := ReadKernelConfig(path)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", path, err)
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: expected: %q, got: %q", path, expected, config)
+		}
+	}
+
+	config, _ := ReadKernelConfig(plain)
+	if !config.BuiltIn("CONFIG_RD_ZSTD") || config.BuiltIn("CONFIG_ZRAM") || config.BuiltIn("CONFIG_RD_BZIP2") {
+		t.Error("unexpected result from BuiltIn")
+	}
+	if !config.Enabled("CONFIG_ZRAM") || config.Enabled("CONFIG_FOO") {
+		t.Error("unexpected result from Enabled")
+	}
+}
@@ -16,11 +16,22 @@ import (
 )
 
 type DeviceInfo struct {
-	InitfsCompression      string
-	InitfsExtraCompression string
-	UbootBoardname         string
-	FormatVersion          string
-	CreateInitfsExtra      bool
+	InitfsCompression          string
+	InitfsExtraCompression     string
+	UbootBoardname             string
+	FormatVersion              string
+	CreateInitfsExtra          bool
+	InitfsStrip                bool
+	InitfsExtraStrip           bool
+	ModulesCompression         string
+	FirmwareCompressionSupport string
+	InitfsHostonly             bool
+	ModulesSkipFirmware        bool
+	ModulesFromDtb             bool
+	Dtb                        string
+
+	// all deviceinfo_* variables, by name, including the ones above
+	values map[string]string
 }
 
 // Reads the relevant entries from "file" into DeviceInfo struct
@@ -50,6 +61,13 @@ func (d *DeviceInfo) unmarshal(file string) error {
 	}
 
 	for k, v := range vars {
+		if strings.HasPrefix(k, "deviceinfo_") {
+			if d.values == nil {
+				d.values = make(map[string]string)
+			}
+			d.values[k] = v.String()
+		}
+
 		fieldName := nameToField(k)
 		field := reflect.ValueOf(d).Elem().FieldByName(fieldName)
 		if !field.IsValid() {
@@ -84,6 +102,13 @@ func (d *DeviceInfo) unmarshal(file string) error {
 	return nil
 }
 
+// Value returns the value of the given deviceinfo variable, e.g.
+// "deviceinfo_arch", including ones that don't have a field in DeviceInfo.
+func (d DeviceInfo) Value(name string) (string, bool) {
+	v, found := d.values[name]
+	return v, found
+}
+
 // Convert string into the string format used for DeviceInfo fields.
 // Note: does not test that the resulting field name is a valid field in the
 // DeviceInfo struct!
@@ -4,6 +4,7 @@
 package deviceinfo
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -67,6 +68,13 @@ func TestUnmarshal(t *testing.T) {
 			InitfsCompression:      "zstd:--foo=1 -T0 --bar=bazz",
 			InitfsExtraCompression: "",
 			CreateInitfsExtra:      true,
+			values: map[string]string{
+				"deviceinfo_format_version":           "0",
+				"deviceinfo_uboot_boardname":          "foobar-bazz",
+				"deviceinfo_initfs_compression":       "zstd:--foo=1 -T0 --bar=bazz",
+				"deviceinfo_initfs_extra_compression": "",
+				"deviceinfo_create_initfs_extra":      "true",
+			},
 		},
 		},
 	}
@@ -75,7 +83,7 @@ func TestUnmarshal(t *testing.T) {
 		if err := d.unmarshal(table.file); err != nil {
 			t.Error(err)
 		}
-		if d != table.expected {
+		if !reflect.DeepEqual(d, table.expected) {
 			t.Errorf("expected: %s, got: %s", table.expected, d)
 		}
 	}